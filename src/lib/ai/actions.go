@@ -1,14 +1,25 @@
 package ai
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/websocket"
 	method "m3u8.com/src/lib/methods"
+	"m3u8.com/src/lib/subtitles"
 )
 
 // export WSCRIBE_MODELS_DIR=/Users/vitaliyshaban/Home/development/apps/subtitles/gradio/whisper-models
@@ -18,62 +29,557 @@ import (
 
 // wscribe transcribe output_audio.wav transcription.vtt -f vtt -m large-v2
 type TranscriptionResWS struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	File    string `json:"file"`
+	Success  bool   `json:"success"`
+	Message  string `json:"message"`
+	File     string `json:"file"`
+	Language string `json:"language,omitempty"`
 }
 
-func GetSubtitlesJSONws(conn *websocket.Conn, file string) (err error) {
-	hash, err := method.GenerateFileHash(file)
-	if err != nil {
-		log.Println("Ошибка при генерации хеша файла:", err)
-		return err
+// Options параметры распознавания для одного запроса
+type Options struct {
+	Model    string `json:"model"`
+	Language string `json:"language"` // код ISO 639-1: ru, be, pl, en
+	Device   string `json:"device"`   // cpu или gpu
+	BeamSize int    `json:"beamSize"`
+	Debug    bool   `json:"debug"` // подробный лог wscribe (-d)
+}
+
+// ProgressFunc получает прогресс распознавания в процентах
+type ProgressFunc func(percent float64)
+
+// Transcriber бэкенд распознавания речи. Результат пишется в output в формате wscribe JSON
+type Transcriber interface {
+	Transcribe(ctx context.Context, audio, output string, opts Options, progress ProgressFunc) error
+}
+
+var (
+	BackendWscribe    = "wscribe"
+	BackendWhisperCpp = "whispercpp"
+	BackendHTTP       = "http"
+)
+
+// NewTranscriber создает бэкенд по имени; настройки берутся из окружения
+func NewTranscriber(backend string) (Transcriber, error) {
+	switch backend {
+	case "", BackendWscribe:
+		return &Wscribe{Bin: "wscribe"}, nil
+	case BackendWhisperCpp:
+		bin := os.Getenv("WHISPER_CPP_BIN")
+		if bin == "" {
+			bin = "whisper-cli"
+		}
+		models := os.Getenv("WHISPER_CPP_MODELS")
+		if models == "" {
+			models = "models"
+		}
+		return &WhisperCpp{Bin: bin, ModelsDir: models}, nil
+	case BackendHTTP:
+		url := os.Getenv("TRANSCRIBE_URL")
+		if url == "" {
+			return nil, fmt.Errorf("TRANSCRIBE_URL is not set")
+		}
+		return &HTTPTranscriber{Url: url, Client: http.DefaultClient}, nil
 	}
-	filename := fmt.Sprintf("%s/%s_%s.%s", "subtitles", hash, "subtitle", "json")
-	cmd := exec.Command("wscribe", "transcribe", file, filename, "-m", "tiny")
+	return nil, fmt.Errorf("unknown transcription backend: %v", backend)
+}
 
+// scanProgress читает вывод процесса построчно (включая строки, обновляемые через \r)
+// и передает найденный регулярным выражением процент в progress
+func scanProgress(r io.Reader, pattern *regexp.Regexp, progress ProgressFunc) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	last := -1.0
+	for scanner.Scan() {
+		match := pattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		percent, err := strconv.ParseFloat(match[1], 64)
+		if err != nil || percent == last {
+			continue
+		}
+		last = percent
+		if progress != nil {
+			progress(percent)
+		}
+	}
+	return scanner.Err()
+}
+
+// runWithProgress запускает команду и разбирает прогресс из объединенного stdout/stderr
+func runWithProgress(cmd *exec.Cmd, pattern *regexp.Regexp, progress ProgressFunc) error {
 	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
 	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := scanProgress(stdout, pattern, progress); err != nil {
+		log.Printf("Ошибка чтения вывода %v: %v", cmd.Path, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%v failed: %w", filepath.Base(cmd.Path), err)
+	}
+	return nil
+}
+
+// Wscribe распознавание через CLI wscribe (faster-whisper)
+type Wscribe struct {
+	Bin string
+}
+
+// wscribe печатает прогресс tqdm: " 45%|████      | 45/100"
+var wscribeProgress = regexp.MustCompile(`(\d+(?:\.\d+)?)%\|`)
+
+// Detection результат определения языка речи
+type Detection struct {
+	Language   string  `json:"language"`
+	Confidence float64 `json:"confidence"`
+	Review     bool    `json:"review"` // низкая уверенность, нужна ручная проверка
+}
+
+// LanguageDetector бэкенд, умеющий определять язык по фрагменту аудио
+type LanguageDetector interface {
+	DetectLanguage(ctx context.Context, audio string, opts Options) (Detection, error)
+}
+
+// LanguageReviewThreshold ниже этой уверенности язык отмечается для ручной проверки
+var LanguageReviewThreshold = 0.6
+
+// DetectLanguage определяет язык речи. wscribe не умеет определять язык,
+// поэтому бэкенд берется из LANGUAGE_DETECT_BACKEND (по умолчанию whisper.cpp)
+func DetectLanguage(ctx context.Context, audio string, opts Options) (Detection, error) {
+	backend := os.Getenv("LANGUAGE_DETECT_BACKEND")
+	if backend == "" {
+		backend = BackendWhisperCpp
+	}
+	transcriber, err := NewTranscriber(backend)
+	if err != nil {
+		return Detection{}, err
+	}
+	detector, ok := transcriber.(LanguageDetector)
+	if !ok {
+		return Detection{}, fmt.Errorf("backend %v can't detect language", backend)
+	}
+
+	detection, err := detector.DetectLanguage(ctx, audio, opts)
+	if err != nil {
+		return Detection{}, err
+	}
+	detection.Review = detection.Confidence < LanguageReviewThreshold
+	return detection, nil
+}
+
+// languageModels модели распознавания под язык; остальным языкам нужна многоязычная модель
+var languageModels = map[string]string{
+	"en": "small.en",
+	"ru": "medium",
+	"pl": "medium",
+	"be": "large-v2",
+}
+
+// ModelForLanguage подбирает модель для языка, fallback — модель по умолчанию
+func ModelForLanguage(language, fallback string) string {
+	if model, ok := languageModels[language]; ok {
+		return model
+	}
+	return fallback
+}
+
+// wscribe принимает название языка, а не код
+var wscribeLanguages = map[string]string{
+	"ru": "Russian",
+	"be": "Belarusian",
+	"pl": "Polish",
+	"en": "English",
+	"uk": "Ukrainian",
+}
+
+func (t *Wscribe) Transcribe(ctx context.Context, audio, output string, opts Options, progress ProgressFunc) error {
+	args := []string{"transcribe", audio, output}
+	if opts.Model != "" {
+		args = append(args, "-m", opts.Model)
+	}
+	if opts.Language != "" {
+		language, ok := wscribeLanguages[opts.Language]
+		if !ok {
+			language = opts.Language
+		}
+		args = append(args, "--language", language)
+	}
+	if opts.Device == "gpu" || opts.Device == "cuda" {
+		args = append(args, "-g")
+	}
+	if opts.Debug {
+		args = append(args, "-d")
+	}
+	if opts.BeamSize > 0 {
+		log.Printf("wscribe не поддерживает beam size, параметр %v пропущен", opts.BeamSize)
+	}
+
+	cmd := exec.CommandContext(ctx, t.Bin, args...)
+	return runWithProgress(cmd, wscribeProgress, progress)
+}
+
+// WhisperCpp распознавание через CLI whisper.cpp
+type WhisperCpp struct {
+	Bin       string
+	ModelsDir string
+}
+
+// modelPattern имя модели становится частью пути к файлу, поэтому допускаются только имена вида large-v2, small.en
+var modelPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// modelFile путь к файлу модели ggml-{model}.bin в ModelsDir
+func (t *WhisperCpp) modelFile(model string) (string, error) {
+	if model == "" {
+		model = "base"
+	}
+	if !modelPattern.MatchString(model) || strings.Contains(model, "..") {
+		return "", fmt.Errorf("invalid model name: %q", model)
+	}
+	return filepath.Join(t.ModelsDir, fmt.Sprintf("ggml-%s.bin", model)), nil
+}
+
+// whisper.cpp с флагом -pp печатает "whisper_print_progress_callback: progress =  45%"
+var whisperCppProgress = regexp.MustCompile(`progress\s*=\s*(\d+(?:\.\d+)?)%`)
+
+// whisper.cpp с флагом -dl печатает "auto-detected language: ru (p = 0.987654)"
+var whisperCppLanguage = regexp.MustCompile(`auto-detected language: (\w+) \(p = ([\d.]+)\)`)
+
+func (t *WhisperCpp) DetectLanguage(ctx context.Context, audio string, opts Options) (Detection, error) {
+	model, err := t.modelFile(opts.Model)
+	if err != nil {
+		return Detection{}, err
+	}
+	args := []string{
+		"-m", model,
+		"-f", audio,
+		"-l", "auto",
+		"-dl",
+	}
+	if opts.Device == "cpu" {
+		args = append(args, "-ng")
+	}
+
+	output, err := exec.CommandContext(ctx, t.Bin, args...).CombinedOutput()
+	if err != nil {
+		return Detection{}, fmt.Errorf("%v failed: %w", t.Bin, err)
+	}
+	match := whisperCppLanguage.FindSubmatch(output)
+	if match == nil {
+		return Detection{}, fmt.Errorf("language was not detected")
+	}
+	confidence, err := strconv.ParseFloat(string(match[2]), 64)
+	if err != nil {
+		return Detection{}, err
+	}
+
+	return Detection{Language: string(match[1]), Confidence: confidence}, nil
+}
+
+type whisperCppToken struct {
+	Text    string `json:"text"`
+	Offsets struct {
+		From int `json:"from"`
+		To   int `json:"to"`
+	} `json:"offsets"`
+	P float64 `json:"p"`
+}
+
+type whisperCppResult struct {
+	Transcription []struct {
+		Offsets struct {
+			From int `json:"from"`
+			To   int `json:"to"`
+		} `json:"offsets"`
+		Text   string            `json:"text"`
+		Tokens []whisperCppToken `json:"tokens"`
+	} `json:"transcription"`
+}
+
+func (t *WhisperCpp) Transcribe(ctx context.Context, audio, output string, opts Options, progress ProgressFunc) error {
+	model, err := t.modelFile(opts.Model)
 	if err != nil {
 		return err
 	}
-	if err = cmd.Start(); err != nil {
+	language := opts.Language
+	if language == "" {
+		language = "auto"
+	}
+	outputBase := strings.TrimSuffix(output, filepath.Ext(output)) + "_whispercpp"
+
+	args := []string{
+		"-m", model,
+		"-f", audio,
+		"-l", language,
+		"-ojf", "-of", outputBase,
+		"-pp",
+	}
+	if opts.BeamSize > 0 {
+		args = append(args, "-bs", strconv.Itoa(opts.BeamSize))
+	}
+	if opts.Device == "cpu" {
+		args = append(args, "-ng")
+	}
+
+	cmd := exec.CommandContext(ctx, t.Bin, args...)
+	if err := runWithProgress(cmd, whisperCppProgress, progress); err != nil {
 		return err
 	}
-	for {
-		tmp := make([]byte, 1024)
-		_, err := stdout.Read(tmp)
-		proc := strings.Split(string(tmp), "%|")
-		if len(proc) > 1 {
-			progress := strings.Trim(proc[0], "\r ")
-			result := TranscriptionResWS{
-				Success: true,
-				Message: progress,
-				File:    "",
-			}
 
-			fmt.Println(result)
-			bytes, err := json.Marshal(result)
-			if err != nil {
-				log.Printf("Error sending progress message: %v", err)
-				break
+	data, err := os.ReadFile(outputBase + ".json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outputBase + ".json")
+
+	var result whisperCppResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("failed to decode whisper.cpp output: %w", err)
+	}
+
+	// Переводим в формат wscribe
+	segments := []subtitles.Segment{}
+	for _, item := range result.Transcription {
+		segment := subtitles.Segment{
+			Text:  strings.TrimSpace(item.Text),
+			Start: subtitles.FormatTimestamp(float64(item.Offsets.From)/1000, "."),
+			End:   subtitles.FormatTimestamp(float64(item.Offsets.To)/1000, "."),
+		}
+		total, count := 0.0, 0
+		for _, token := range item.Tokens {
+			// служебные токены [_BEG_], [_TT_150] и т.п.
+			if strings.HasPrefix(token.Text, "[_") {
+				continue
+			}
+			total += token.P
+			count++
+			start := subtitles.FormatTimestamp(float64(token.Offsets.From)/1000, ".")
+			end := subtitles.FormatTimestamp(float64(token.Offsets.To)/1000, ".")
+			// токен без пробела в начале продолжает предыдущее слово
+			if n := len(segment.Words); n > 0 && !strings.HasPrefix(token.Text, " ") {
+				segment.Words[n-1].Text += token.Text
+				segment.Words[n-1].End = end
+				segment.Words[n-1].Score = (segment.Words[n-1].Score + token.P) / 2
+				continue
 			}
+			segment.Words = append(segment.Words, subtitles.Word{
+				Start: start,
+				End:   end,
+				Text:  strings.TrimSpace(token.Text),
+				Score: token.P,
+			})
+		}
+		if count > 0 {
+			segment.Score = total / float64(count)
+		}
+		if segment.Text != "" {
+			segments = append(segments, segment)
+		}
+	}
+
+	return subtitles.WriteTranscript(segments, output)
+}
 
-			err = conn.WriteMessage(websocket.TextMessage, bytes)
-			if err != nil {
-				log.Printf("Error sending progress message: %v", err)
-				break
+// HTTPTranscriber распознавание через внешний HTTP сервис.
+// POST {Url}/transcribe (multipart: file, model, language, device, beam_size),
+// ответ — NDJSON: строки {"progress": 45} и финальная {"segments": [...]} в формате wscribe
+type HTTPTranscriber struct {
+	Url    string
+	Client *http.Client
+}
+
+type httpTranscriptionLine struct {
+	Progress *float64            `json:"progress"`
+	Segments []subtitles.Segment `json:"segments"`
+	Error    string              `json:"error"`
+}
+
+func (t *HTTPTranscriber) Transcribe(ctx context.Context, audio, output string, opts Options, progress ProgressFunc) error {
+	file, err := os.Open(audio)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", filepath.Base(audio))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return err
+	}
+	fields := map[string]string{
+		"model":    opts.Model,
+		"language": opts.Language,
+		"device":   opts.Device,
+	}
+	if opts.BeamSize > 0 {
+		fields["beam_size"] = strconv.Itoa(opts.BeamSize)
+	}
+	for key, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := writer.WriteField(key, value); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(t.Url, "/")+"/transcribe", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	res, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("transcription service returned %v: %s", res.Status, message)
+	}
+
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var line httpTranscriptionLine
+		if err := decoder.Decode(&line); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("transcription service closed stream without segments")
 			}
+			return fmt.Errorf("failed to decode transcription response: %w", err)
+		}
+		if line.Error != "" {
+			return fmt.Errorf("transcription service: %v", line.Error)
+		}
+		if line.Progress != nil && progress != nil {
+			progress(*line.Progress)
+		}
+		if line.Segments != nil {
+			return subtitles.WriteTranscript(line.Segments, output)
+		}
+	}
+}
+
+// DetectLanguage POST {Url}/detect (multipart: file), ответ {"language": "ru", "probability": 0.97}
+func (t *HTTPTranscriber) DetectLanguage(ctx context.Context, audio string, opts Options) (Detection, error) {
+	file, err := os.Open(audio)
+	if err != nil {
+		return Detection{}, err
+	}
+	defer file.Close()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", filepath.Base(audio))
+	if err != nil {
+		return Detection{}, err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return Detection{}, err
+	}
+	if opts.Model != "" {
+		if err := writer.WriteField("model", opts.Model); err != nil {
+			return Detection{}, err
 		}
+	}
+	if err := writer.Close(); err != nil {
+		return Detection{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(t.Url, "/")+"/detect", body)
+	if err != nil {
+		return Detection{}, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	res, err := t.Client.Do(req)
+	if err != nil {
+		return Detection{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return Detection{}, fmt.Errorf("transcription service returned %v: %s", res.Status, message)
+	}
+
+	var result struct {
+		Language    string  `json:"language"`
+		Probability float64 `json:"probability"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return Detection{}, fmt.Errorf("failed to decode detection response: %w", err)
+	}
+	if result.Language == "" {
+		return Detection{}, fmt.Errorf("language was not detected")
+	}
+
+	return Detection{Language: result.Language, Confidence: result.Probability}, nil
+}
+
+func GetSubtitlesJSONws(conn *websocket.Conn, file string, backend string, opts Options) (err error) {
+	hash, err := method.GenerateFileHash(file)
+	if err != nil {
+		log.Println("Ошибка при генерации хеша файла:", err)
+		return err
+	}
+	filename := fmt.Sprintf("%s/%s_%s.%s", "subtitles", hash, "subtitle", "json")
+
+	transcriber, err := NewTranscriber(backend)
+	if err != nil {
+		return err
+	}
+	if opts.Model == "" {
+		opts.Model = "tiny"
+	}
+
+	err = transcriber.Transcribe(context.Background(), file, filename, opts, func(percent float64) {
+		result := TranscriptionResWS{
+			Success: true,
+			Message: strconv.FormatFloat(percent, 'f', 0, 64),
+			File:    "",
+		}
+
+		fmt.Println(result)
+		bytes, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("Error sending progress message: %v", err)
+			return
+		}
+
+		err = conn.WriteMessage(websocket.TextMessage, bytes)
 		if err != nil {
-			break
+			log.Printf("Error sending progress message: %v", err)
 		}
+	})
+	if err != nil {
+		return err
 	}
 
 	result := TranscriptionResWS{
-		Success: true,
-		Message: "100",
-		File:    filename,
+		Success:  true,
+		Message:  "100",
+		File:     filename,
+		Language: opts.Language,
 	}
 
 	bytes, err := json.Marshal(result)
@@ -89,28 +595,18 @@ func GetSubtitlesJSONws(conn *websocket.Conn, file string) (err error) {
 	return nil
 }
 
-func GetSubtitlesJSON() error {
-	cmd := exec.Command("wscribe", "transcribe", "audios/output_audio.m4a", "subtitles/output_audio.json", "-m", "large-v2", "-d")
-
-	stdout, err := cmd.StdoutPipe()
-	cmd.Stderr = cmd.Stdout
+func GetSubtitlesJSON(backend string, opts Options) error {
+	transcriber, err := NewTranscriber(backend)
 	if err != nil {
 		return err
 	}
-	if err = cmd.Start(); err != nil {
-		return err
-	}
-	for {
-		tmp := make([]byte, 1024)
-		_, err := stdout.Read(tmp)
-		proc := strings.Split(string(tmp), "%|")
-		if len(proc) > 1 {
-			fmt.Println(strings.Trim(proc[0], ""))
-		}
-		if err != nil {
-			break
-		}
+	if opts.Model == "" {
+		opts.Model = "large-v2"
 	}
+	// Пакетное распознавание всегда шло с подробным логом wscribe
+	opts.Debug = true
 
-	return nil
+	return transcriber.Transcribe(context.Background(), "audios/output_audio.m4a", "subtitles/output_audio.json", opts, func(percent float64) {
+		fmt.Println(percent)
+	})
 }
@@ -0,0 +1,561 @@
+package channel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"m3u8.com/src/lib/ffmpeg"
+	fb "m3u8.com/src/lib/firebase"
+)
+
+// Collection каналы в Firestore, id документа — id канала
+var Collection = "channels"
+
+// AudioRendition имя плейлиста звука канала
+var AudioRendition = "audio"
+
+// Item передача расписания: видео начинается в Start и идет до конца или до следующей передачи
+type Item struct {
+	Video string    `json:"video" firestore:"video"`
+	Start time.Time `json:"start" firestore:"start"`
+	Title string    `json:"title" firestore:"title"` // по умолчанию название видео
+}
+
+// Channel линейный канал из уже сегментированных видео
+type Channel struct {
+	Id          string   `json:"id" firestore:"-"`
+	Name        string   `json:"name" firestore:"name"`
+	Resolutions []string `json:"resolutions" firestore:"resolutions"` // варианты канала, по умолчанию 1280x720
+	Schedule    []Item   `json:"schedule" firestore:"schedule"`
+	Filler      string   `json:"filler" firestore:"filler"` // видео, которое крутится в промежутках
+	Window      int      `json:"window" firestore:"window"` // сегментов в плейлисте, по умолчанию 6
+
+	// TargetDuration максимальная длина сегмента среди всех видео канала; считается при загрузке,
+	// чтобы #EXT-X-TARGETDURATION не менялся от запроса к запросу
+	TargetDuration int `json:"targetDuration" firestore:"-"`
+}
+
+func (c Channel) withDefaults() Channel {
+	if len(c.Resolutions) == 0 {
+		c.Resolutions = []string{"1280x720"}
+	}
+	if c.Window <= 0 {
+		c.Window = 6
+	}
+	sort.SliceStable(c.Schedule, func(i, j int) bool {
+		return c.Schedule[i].Start.Before(c.Schedule[j].Start)
+	})
+	return c
+}
+
+// Segment сегмент готового видео с абсолютной ссылкой на Firestorage
+type Segment struct {
+	Duration float64
+	Uri      string
+}
+
+// Asset сегменты видео, из которых собирается эфир
+type Asset struct {
+	Id        string
+	Title     string
+	Duration  float64
+	Video     map[int][]Segment // по высоте кадра
+	Bandwidth map[int]int
+	Audio     []Segment
+}
+
+// video сегменты варианта с высотой кадра, ближайшей к height
+func (a *Asset) video(height int) ([]Segment, int) {
+	best := -1
+	for h := range a.Video {
+		if best < 0 || math.Abs(float64(h-height)) < math.Abs(float64(best-height)) ||
+			(math.Abs(float64(h-height)) == math.Abs(float64(best-height)) && h > best) {
+			best = h
+		}
+	}
+	return a.Video[best], a.Bandwidth[best]
+}
+
+// targetDuration максимальная длина сегмента среди всех вариантов и звука видео, округленная как в #EXTINF
+func targetDuration(assets map[string]*Asset) int {
+	target := 1
+	for _, asset := range assets {
+		lists := [][]Segment{asset.Audio}
+		for _, segments := range asset.Video {
+			lists = append(lists, segments)
+		}
+		for _, segments := range lists {
+			for _, segment := range segments {
+				target = max(target, int(math.Round(segment.Duration)))
+			}
+		}
+	}
+	return target
+}
+
+// assetMetadata поля документа видео, нужные для эфира
+type assetMetadata struct {
+	Title    string                  `firestore:"title"`
+	Duration float64                 `firestore:"duration"`
+	Variants []ffmpeg.Variant        `firestore:"variants"`
+	Audio    []ffmpeg.MediaRendition `firestore:"audio"`
+}
+
+// loadAsset читает плейлисты вариантов H.264 и звуковой дорожки по умолчанию.
+// Канал объявляет общую звуковую группу, поэтому видео без отдельных звуковых рендиций не подходят
+func loadAsset(ctx context.Context, id string) (*Asset, error) {
+	var metadata assetMetadata
+	if err := fb.GetVideoMetadata(ctx, id, &metadata); err != nil {
+		return nil, err
+	}
+
+	asset := &Asset{Id: id, Title: metadata.Title, Duration: metadata.Duration, Video: map[int][]Segment{}, Bandwidth: map[int]int{}}
+	for _, variant := range metadata.Variants {
+		// Сегменты fMP4 (HEVC, AV1) нельзя чередовать с MPEG-TS в одном плейлисте
+		if variant.Codec != "" && variant.Codec != ffmpeg.CodecH264 {
+			continue
+		}
+		size := strings.Split(variant.Resolution, "x")
+		if len(size) != 2 {
+			continue
+		}
+		height, err := strconv.Atoi(size[1])
+		if err != nil {
+			continue
+		}
+		segments, err := readPlaylist(ctx, variant.Uri)
+		if err != nil {
+			return nil, fmt.Errorf("video %s variant %s: %v", id, variant.Resolution, err)
+		}
+		asset.Video[height] = segments
+		asset.Bandwidth[height] = variant.Bandwidth
+	}
+	if len(asset.Video) == 0 {
+		return nil, fmt.Errorf("video %s has no H.264 segments", id)
+	}
+
+	var audio *ffmpeg.MediaRendition
+	for i := range metadata.Audio {
+		if audio == nil || metadata.Audio[i].Default {
+			audio = &metadata.Audio[i]
+		}
+	}
+	if audio == nil {
+		return nil, fmt.Errorf("video %s has no separate audio rendition, segment it again", id)
+	}
+	segments, err := readPlaylist(ctx, audio.Uri)
+	if err != nil {
+		return nil, fmt.Errorf("video %s audio: %v", id, err)
+	}
+	asset.Audio = segments
+
+	if asset.Duration <= 0 {
+		for _, segment := range asset.Audio {
+			asset.Duration += segment.Duration
+		}
+	}
+	return asset, nil
+}
+
+// objectPath путь объекта Firestorage из ссылки вида /segments%2Fhash%2Fname.m3u8?alt=media
+func objectPath(uri string) string {
+	uri, _, _ = strings.Cut(uri, "?")
+	return strings.TrimPrefix(strings.ReplaceAll(uri, "%2F", "/"), "/")
+}
+
+// readPlaylist читает медиа-плейлист видео; ссылки на сегменты становятся абсолютными,
+// так как плейлист канала отдает наш сервер, а сегменты лежат в Firestorage
+func readPlaylist(ctx context.Context, uri string) ([]Segment, error) {
+	object := objectPath(uri)
+	data, err := fb.ReadFile(ctx, object)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []Segment{}
+	duration := 0.0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.TrimPrefix(line, "#EXTINF:")
+			duration, _ = strconv.ParseFloat(strings.Split(value, ",")[0], 64)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			segment := objectPath(line)
+			if !strings.HasPrefix(segment, "segments/") {
+				segment = path.Join(path.Dir(object), segment)
+			}
+			segments = append(segments, Segment{Duration: duration, Uri: fb.StorageUrl(segment)})
+		}
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("empty playlist %s", object)
+	}
+	return segments, scanner.Err()
+}
+
+// Play показ видео в эфире
+type Play struct {
+	Video  string    `json:"video"`
+	Title  string    `json:"title"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Filler bool      `json:"filler"`
+	asset  *Asset
+}
+
+// plays эфир канала, пересекающий [from, until]: передачи обрезаются следующими,
+// промежутки заполняются повторами заставки. Показы, закончившиеся до from, не собираются,
+// а передаются в skip; повторы заставки передаются одним вызовом с их числом
+func (c Channel) plays(assets map[string]*Asset, from, until time.Time, skip func(play Play, repeats int)) []Play {
+	plays := []Play{}
+	add := func(play Play, repeats int) {
+		if play.End.After(from) {
+			plays = append(plays, play)
+		} else if skip != nil {
+			skip(play, repeats)
+		}
+	}
+	filler := assets[c.Filler]
+	fill := func(start, end time.Time) {
+		if filler == nil || filler.Duration <= 0 {
+			return
+		}
+		length := time.Duration(filler.Duration * float64(time.Second))
+		// Полные повторы до from пропускаются разом
+		if from.After(start) {
+			repeats := min(int(from.Sub(start)/length), int(end.Sub(start)/length))
+			if repeats > 0 {
+				add(Play{Video: filler.Id, Title: filler.Title, Start: start, End: start.Add(length), Filler: true, asset: filler}, repeats)
+				start = start.Add(time.Duration(repeats) * length)
+			}
+		}
+		for start.Before(end) {
+			stop := start.Add(length)
+			if stop.After(end) {
+				stop = end
+			}
+			add(Play{Video: filler.Id, Title: filler.Title, Start: start, End: stop, Filler: true, asset: filler}, 1)
+			start = stop
+		}
+	}
+
+	for i, item := range c.Schedule {
+		if item.Start.After(until) {
+			break
+		}
+		asset := assets[item.Video]
+		if asset == nil {
+			continue
+		}
+		end := item.Start.Add(time.Duration(asset.Duration * float64(time.Second)))
+		next := until
+		if i+1 < len(c.Schedule) {
+			next = c.Schedule[i+1].Start
+			if end.After(next) {
+				end = next
+			}
+			if next.After(until) {
+				next = until
+			}
+		}
+		title := item.Title
+		if title == "" {
+			title = asset.Title
+		}
+		add(Play{Video: item.Video, Title: title, Start: item.Start, End: end, asset: asset}, 1)
+		fill(end, next)
+	}
+	return plays
+}
+
+// entry сегмент в эфире
+type entry struct {
+	segment       Segment
+	start         time.Time
+	discontinuity bool // первый сегмент показа
+}
+
+// segmentTolerance насколько последний сегмент показа может выйти за его конец
+var segmentTolerance = 0.5
+
+// fit сколько первых сегментов показывается за length
+func fit(segments []Segment, length time.Duration) int {
+	elapsed := time.Duration(0)
+	for n, segment := range segments {
+		elapsed += time.Duration(segment.Duration * float64(time.Second))
+		if (elapsed - length).Seconds() > segmentTolerance {
+			return n
+		}
+	}
+	return len(segments)
+}
+
+// Playlist скользящий медиа-плейлист варианта (высота кадра) или звука на момент now.
+// Номера сегментов и разрывов считаются от начала расписания, поэтому не меняются между запросами:
+// сегменты показов до окна считаются без обхода, по длине показа
+func (c Channel) Playlist(assets map[string]*Asset, rendition string, now time.Time) (string, error) {
+	c = c.withDefaults()
+	height := 0
+	if rendition != AudioRendition {
+		var err error
+		if height, err = strconv.Atoi(rendition); err != nil {
+			return "", fmt.Errorf("unknown rendition %s", rendition)
+		}
+	}
+	segmentsOf := func(asset *Asset) []Segment {
+		if rendition == AudioRendition {
+			return asset.Audio
+		}
+		segments, _ := asset.video(height)
+		return segments
+	}
+	target := c.TargetDuration
+	if target <= 0 {
+		target = targetDuration(assets)
+	}
+
+	// Окно — последние c.Window сегментов, каждый не длиннее target (с учетом округления)
+	from := now.Add(-time.Duration(c.Window+1) * time.Duration(target+1) * time.Second)
+	sequence, discontinuities, played := 0, 0, 0
+	skip := func(play Play, repeats int) {
+		if n := fit(segmentsOf(play.asset), play.End.Sub(play.Start)); n > 0 {
+			// Первый сегмент показа начинается с разрыва, если до него уже были сегменты
+			discontinuities += repeats
+			if sequence == 0 {
+				discontinuities--
+			}
+			sequence += n * repeats
+		}
+		played += repeats
+	}
+
+	window := []entry{}
+	for _, play := range c.plays(assets, from, now, skip) {
+		segments := segmentsOf(play.asset)
+		start := play.Start
+		for n, segment := range segments[:fit(segments, play.End.Sub(play.Start))] {
+			if start.After(now) {
+				break
+			}
+			e := entry{segment: segment, start: start, discontinuity: n == 0 && played > 0}
+			if len(window) == 0 && e.discontinuity && sequence > 0 {
+				// Разрыв в начале окна не выводится, но учитывается в счетчике
+				discontinuities++
+			}
+			window = append(window, e)
+			if len(window) > c.Window {
+				// Вышедший из окна сегмент сдвигает номер первого сегмента и счетчик разрывов
+				if window[1].discontinuity {
+					discontinuities++
+				}
+				window = window[1:]
+				sequence++
+			}
+			start = start.Add(time.Duration(segment.Duration * float64(time.Second)))
+		}
+		played++
+	}
+	if len(window) == 0 {
+		return "", fmt.Errorf("channel %s is off air", c.Id)
+	}
+
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\n", target)
+	fmt.Fprintf(&playlist, "#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+	fmt.Fprintf(&playlist, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuities)
+	for i, e := range window {
+		if e.discontinuity && i > 0 {
+			playlist.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if e.discontinuity || i == 0 {
+			fmt.Fprintf(&playlist, "#EXT-X-PROGRAM-DATE-TIME:%s\n", e.start.UTC().Format("2006-01-02T15:04:05.000Z"))
+		}
+		fmt.Fprintf(&playlist, "#EXTINF:%.3f,\n%s\n", e.segment.Duration, e.segment.Uri)
+	}
+	return playlist.String(), nil
+}
+
+// Master мастер-плейлист канала: варианты по разрешениям канала и общая звуковая группа
+func (c Channel) Master(assets map[string]*Asset) (string, error) {
+	c = c.withDefaults()
+	codecs, err := ffmpeg.CodecsString(ffmpeg.CodecH264)
+	if err != nil {
+		return "", err
+	}
+
+	name := c.Name
+	if name == "" {
+		name = c.Id
+	}
+	master := ffmpeg.MasterPlaylist{
+		Audio: []ffmpeg.MediaRendition{{
+			Type:       ffmpeg.AudioMediaType,
+			GroupId:    ffmpeg.AudioGroupId,
+			Name:       name,
+			Uri:        AudioRendition + ".m3u8",
+			Default:    true,
+			AutoSelect: true,
+		}},
+	}
+	for _, resolution := range c.Resolutions {
+		size := strings.Split(resolution, "x")
+		if len(size) != 2 {
+			return "", fmt.Errorf("invalid resolution: %s", resolution)
+		}
+		height, err := strconv.Atoi(size[1])
+		if err != nil {
+			return "", fmt.Errorf("invalid resolution: %s", resolution)
+		}
+		// Пиковый битрейт среди видео канала
+		bandwidth := 0
+		for _, asset := range assets {
+			_, b := asset.video(height)
+			bandwidth = max(bandwidth, b)
+		}
+		master.Variants = append(master.Variants, ffmpeg.Variant{
+			Resolution: resolution,
+			Uri:        size[1] + ".m3u8",
+			Bandwidth:  bandwidth,
+			Codec:      ffmpeg.CodecH264,
+			Codecs:     codecs,
+		})
+	}
+
+	var playlist bytes.Buffer
+	if err := ffmpeg.WriteMasterM3U8(&playlist, master); err != nil {
+		return "", err
+	}
+	return playlist.String(), nil
+}
+
+// EPG программа передач, пересекающих интервал [from, to)
+func (c Channel) EPG(assets map[string]*Asset, from, to time.Time) []Play {
+	c = c.withDefaults()
+	result := []Play{}
+	for _, play := range c.plays(assets, from, to, nil) {
+		if play.Start.Before(to) {
+			result = append(result, play)
+		}
+	}
+	return result
+}
+
+type cached struct {
+	channel Channel
+	loaded  time.Time
+}
+
+// Manager хранит каналы и сегменты их видео. Каналы перечитываются из Firestore раз в cacheTTL,
+// сегменты видео не меняются и загружаются один раз
+type Manager struct {
+	mu       sync.Mutex
+	channels map[string]cached
+	assets   map[string]*Asset
+}
+
+var cacheTTL = time.Minute
+
+func NewManager() *Manager {
+	return &Manager{channels: map[string]cached{}, assets: map[string]*Asset{}}
+}
+
+// Save проверяет, что все видео расписания подходят для эфира, и сохраняет канал
+func (m *Manager) Save(ctx context.Context, channel Channel) error {
+	if channel.Id == "" {
+		return fmt.Errorf("missing channel id")
+	}
+	channel = channel.withDefaults()
+	for _, resolution := range channel.Resolutions {
+		if len(strings.Split(resolution, "x")) != 2 {
+			return fmt.Errorf("invalid resolution: %s", resolution)
+		}
+	}
+	assets, err := m.load(ctx, channel, true)
+	if err != nil {
+		return err
+	}
+	channel.TargetDuration = targetDuration(assets)
+	if err := fb.SetDocument(ctx, Collection, channel.Id, channel); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.channels[channel.Id] = cached{channel: channel, loaded: time.Now()}
+	m.mu.Unlock()
+	return nil
+}
+
+// Channel канал с загруженными видео
+func (m *Manager) Channel(ctx context.Context, id string) (Channel, map[string]*Asset, error) {
+	m.mu.Lock()
+	entry, ok := m.channels[id]
+	m.mu.Unlock()
+
+	if ok && time.Since(entry.loaded) <= cacheTTL {
+		assets, err := m.load(ctx, entry.channel, false)
+		if err != nil {
+			return Channel{}, nil, err
+		}
+		return entry.channel, assets, nil
+	}
+
+	var channel Channel
+	if err := fb.GetDocument(ctx, Collection, id, &channel); err != nil {
+		return Channel{}, nil, err
+	}
+	channel.Id = id
+	channel = channel.withDefaults()
+	assets, err := m.load(ctx, channel, false)
+	if err != nil {
+		return Channel{}, nil, err
+	}
+	channel.TargetDuration = targetDuration(assets)
+	m.mu.Lock()
+	m.channels[id] = cached{channel: channel, loaded: time.Now()}
+	m.mu.Unlock()
+	return channel, assets, nil
+}
+
+// load загружает видео расписания и заставку; reload перечитывает уже загруженные
+func (m *Manager) load(ctx context.Context, channel Channel, reload bool) (map[string]*Asset, error) {
+	ids := []string{}
+	for _, item := range channel.Schedule {
+		ids = append(ids, item.Video)
+	}
+	if channel.Filler != "" {
+		ids = append(ids, channel.Filler)
+	}
+
+	assets := map[string]*Asset{}
+	for _, id := range ids {
+		if _, ok := assets[id]; ok {
+			continue
+		}
+		m.mu.Lock()
+		asset, ok := m.assets[id]
+		m.mu.Unlock()
+		if !ok || reload {
+			var err error
+			if asset, err = loadAsset(ctx, id); err != nil {
+				return nil, err
+			}
+			m.mu.Lock()
+			m.assets[id] = asset
+			m.mu.Unlock()
+		}
+		assets[id] = asset
+	}
+	return assets, nil
+}
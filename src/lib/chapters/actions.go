@@ -0,0 +1,357 @@
+package chapters
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	fb "m3u8.com/src/lib/firebase"
+	"m3u8.com/src/lib/subtitles"
+)
+
+// Options настройки автоматической разбивки на главы
+type Options struct {
+	MinChapterDuration float64 `json:"minChapterDuration"` // минимальная длина главы в секундах
+	MaxChapters        int     `json:"maxChapters"`
+	PauseThreshold     float64 `json:"pauseThreshold"` // пауза в речи (сек), которая считается сильной границей
+	SceneTolerance     float64 `json:"sceneTolerance"` // допустимое расстояние (сек) от смены сцены до границы
+	Window             int     `json:"window"`         // количество сегментов в окне лексической связности
+	MinScore           float64 `json:"minScore"`       // минимальная оценка границы
+}
+
+func (o Options) withDefaults() Options {
+	if o.MinChapterDuration <= 0 {
+		o.MinChapterDuration = 60
+	}
+	if o.MaxChapters <= 0 {
+		o.MaxChapters = 10
+	}
+	if o.PauseThreshold <= 0 {
+		o.PauseThreshold = 1.5
+	}
+	if o.SceneTolerance <= 0 {
+		o.SceneTolerance = 1.5
+	}
+	if o.Window <= 0 {
+		o.Window = 4
+	}
+	if o.MinScore <= 0 {
+		o.MinScore = 0.35
+	}
+	return o
+}
+
+// Веса признаков границы главы
+var (
+	lexicalWeight = 0.5
+	pauseWeight   = 0.3
+	sceneWeight   = 0.2
+)
+
+var stopWords = map[string]bool{}
+
+func init() {
+	words := "и в во не что он на я с со как а то все она так его но да ты к у же вы за бы по только ее мне было вот от меня еще нет о из ему теперь когда даже ну вдруг ли если уже или ни быть был него до вас нибудь опять уж вам ведь там потом себя ничего ей может они тут где есть надо ней для мы тебя их чем была сам чтоб без будто чего раз тоже себе под будет ж тогда кто этот того потому этого какой совсем ним здесь этом один почти мой тем чтобы нее сейчас были куда зачем всех никогда можно при наконец два об другой хоть после над больше тот через эти нас про всего них какая много разве три эту моя впрочем хорошо свою этой перед иногда лучше чуть том нельзя такой им более всегда конечно всю между это мы вот так очень также " +
+		"the a an and or but if then of to in on at by for with about as into from up down is are was were be been being have has had do does did not no so that this these those it its we you they he she them our your their there here what which who when where why how all any each just very can will would should"
+	for _, word := range strings.Fields(words) {
+		stopWords[word] = true
+	}
+}
+
+// tokens возвращает значимые слова текста, приведенные к грубой основе
+func tokens(text string) []string {
+	result := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if stopWords[word] || utf8.RuneCountInString(word) < 3 {
+			continue
+		}
+		result = append(result, stem(word))
+	}
+	return result
+}
+
+// stem обрезает слово до первых шести букв — достаточно для сравнения словоформ
+func stem(word string) string {
+	runes := []rune(word)
+	if len(runes) > 6 {
+		runes = runes[:6]
+	}
+	return string(runes)
+}
+
+type block struct {
+	start  float64
+	end    float64
+	text   string
+	tokens []string
+}
+
+func cosine(a, b map[string]float64) float64 {
+	dot, na, nb := 0.0, 0.0, 0.0
+	for key, value := range a {
+		dot += value * b[key]
+		na += value * value
+	}
+	for _, value := range b {
+		nb += value * value
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+func bag(blocks []block) map[string]float64 {
+	result := map[string]float64{}
+	for _, b := range blocks {
+		for _, token := range b.tokens {
+			result[token]++
+		}
+	}
+	return result
+}
+
+// Suggest предлагает главы по транскрипции: границы ищутся по паузам в речи,
+// сменам сцен (scenes — время в секундах) и падению лексической связности между соседними окнами
+func Suggest(segments []subtitles.Segment, scenes []float64, duration float64, opts Options) ([]fb.Chapter, error) {
+	opts = opts.withDefaults()
+
+	blocks := []block{}
+	for _, segment := range segments {
+		start, err := subtitles.ParseTimestamp(segment.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := subtitles.ParseTimestamp(segment.End)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block{start: start, end: end, text: strings.TrimSpace(segment.Text), tokens: tokens(segment.Text)})
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("transcript is empty")
+	}
+	if duration < blocks[len(blocks)-1].end {
+		duration = blocks[len(blocks)-1].end
+	}
+
+	type candidate struct {
+		index int
+		score float64
+	}
+	candidates := []candidate{}
+	for i := 1; i < len(blocks); i++ {
+		before := blocks[max(0, i-opts.Window):i]
+		after := blocks[i:min(len(blocks), i+opts.Window)]
+		lexical := 1 - cosine(bag(before), bag(after))
+
+		pause := math.Min((blocks[i].start-blocks[i-1].end)/opts.PauseThreshold, 1)
+		if pause < 0 {
+			pause = 0
+		}
+
+		scene := 0.0
+		for _, t := range scenes {
+			if math.Abs(t-blocks[i].start) <= opts.SceneTolerance || (t > blocks[i-1].end && t < blocks[i].start) {
+				scene = 1
+				break
+			}
+		}
+
+		score := lexicalWeight*lexical + pauseWeight*pause + sceneWeight*scene
+		if score >= opts.MinScore {
+			candidates = append(candidates, candidate{index: i, score: score})
+		}
+	}
+	sort.Slice(candidates, func(a, b int) bool {
+		return candidates[a].score > candidates[b].score
+	})
+
+	// Жадно берем лучшие границы, соблюдая минимальную длину главы
+	boundaries := []float64{0, duration}
+	for _, c := range candidates {
+		if len(boundaries)-1 >= opts.MaxChapters {
+			break
+		}
+		t := blocks[c.index].start
+		ok := true
+		for _, b := range boundaries {
+			if math.Abs(b-t) < opts.MinChapterDuration {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			boundaries = append(boundaries, t)
+		}
+	}
+	sort.Float64s(boundaries)
+
+	// Тексты глав для заголовков
+	texts := make([][]block, len(boundaries)-1)
+	for _, b := range blocks {
+		n := sort.SearchFloat64s(boundaries, b.start+1e-6) - 1
+		if n >= len(texts) {
+			n = len(texts) - 1
+		}
+		texts[n] = append(texts[n], b)
+	}
+	df := map[string]int{}
+	for _, chapter := range texts {
+		for token := range bag(chapter) {
+			df[token]++
+		}
+	}
+
+	result := []fb.Chapter{}
+	for n := 0; n < len(boundaries)-1; n++ {
+		result = append(result, fb.Chapter{
+			Start: subtitles.FormatTimestamp(boundaries[n], "."),
+			End:   subtitles.FormatTimestamp(boundaries[n+1], "."),
+			Text:  title(texts[n], df, len(texts)),
+		})
+	}
+
+	return result, nil
+}
+
+// title составляет заголовок главы из ключевых слов (tf-idf) или начала первой фразы
+func title(blocks []block, df map[string]int, total int) string {
+	if len(blocks) == 0 {
+		return "Глава"
+	}
+
+	// Исходная словоформа для каждой основы — первая встреченная
+	forms := map[string]string{}
+	for _, b := range blocks {
+		for _, word := range strings.FieldsFunc(b.text, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			lower := strings.ToLower(word)
+			if stopWords[lower] || utf8.RuneCountInString(lower) < 3 {
+				continue
+			}
+			if _, ok := forms[stem(lower)]; !ok {
+				forms[stem(lower)] = lower
+			}
+		}
+	}
+
+	type keyword struct {
+		token string
+		score float64
+	}
+	keywords := []keyword{}
+	for token, tf := range bag(blocks) {
+		idf := math.Log(float64(total+1) / float64(df[token]))
+		if tf < 2 || idf <= 0 {
+			continue
+		}
+		keywords = append(keywords, keyword{token: token, score: tf * idf})
+	}
+	sort.Slice(keywords, func(a, b int) bool {
+		if keywords[a].score == keywords[b].score {
+			return keywords[a].token < keywords[b].token
+		}
+		return keywords[a].score > keywords[b].score
+	})
+
+	if len(keywords) > 0 {
+		words := []string{}
+		for _, k := range keywords[:min(3, len(keywords))] {
+			words = append(words, forms[k.token])
+		}
+		return capitalize(strings.Join(words, ", "))
+	}
+
+	words := strings.Fields(blocks[0].text)
+	if len(words) > 6 {
+		return capitalize(strings.Join(words[:6], " ")) + "…"
+	}
+	return capitalize(strings.Join(words, " "))
+}
+
+func capitalize(text string) string {
+	r, size := utf8.DecodeRuneInString(text)
+	if r == utf8.RuneError {
+		return text
+	}
+	return string(unicode.ToUpper(r)) + text[size:]
+}
+
+// Span глава с временем в секундах
+type Span struct {
+	Start float64
+	End   float64
+	Title string
+}
+
+// durationTolerance допустимый выход конца главы за длительность видео (округление ffprobe)
+var durationTolerance = 0.5
+
+// Validate разбирает время глав, сортирует их и проверяет на пересечения и выход
+// за длительность видео (duration <= 0 — длительность неизвестна). Возвращает все найденные ошибки
+func Validate(list []fb.Chapter, duration float64) ([]Span, error) {
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no chapters")
+	}
+
+	problems := []error{}
+	spans := []Span{}
+	for n, chapter := range list {
+		start, err := subtitles.ParseTimestamp(chapter.Start)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("chapter %d: invalid start %q", n+1, chapter.Start))
+			continue
+		}
+		end, err := subtitles.ParseTimestamp(chapter.End)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("chapter %d: invalid end %q", n+1, chapter.End))
+			continue
+		}
+		title := strings.TrimSpace(chapter.Text)
+		if title == "" {
+			problems = append(problems, fmt.Errorf("chapter %d: empty title", n+1))
+		}
+		if end <= start {
+			problems = append(problems, fmt.Errorf("chapter %d: end %v is not after start %v", n+1, chapter.End, chapter.Start))
+		}
+		if duration > 0 && end > duration+durationTolerance {
+			problems = append(problems, fmt.Errorf("chapter %d: end %v is beyond video duration %v", n+1, chapter.End, subtitles.FormatTimestamp(duration, ".")))
+		}
+		spans = append(spans, Span{Start: start, End: end, Title: title})
+	}
+
+	sort.SliceStable(spans, func(a, b int) bool {
+		return spans[a].Start < spans[b].Start
+	})
+	for i := 1; i < len(spans); i++ {
+		if spans[i].Start < spans[i-1].End {
+			problems = append(problems, fmt.Errorf("chapters %q and %q overlap", spans[i-1].Title, spans[i].Title))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.Join(problems...)
+	}
+	return spans, nil
+}
+
+// ToChapters переводит главы обратно в формат Firestore с нормализованным временем
+func ToChapters(spans []Span) []fb.Chapter {
+	result := make([]fb.Chapter, len(spans))
+	for i, span := range spans {
+		result[i] = fb.Chapter{
+			Start: subtitles.FormatTimestamp(span.Start, "."),
+			End:   subtitles.FormatTimestamp(span.End, "."),
+			Text:  span.Title,
+		}
+	}
+	return result
+}
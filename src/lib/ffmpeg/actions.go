@@ -4,12 +4,18 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	method "m3u8.com/src/lib/methods"
@@ -22,10 +28,178 @@ var (
 type ProgressData struct {
 	Success          bool     `json:"success"`
 	Error            string   `json:"error"`
-	Resolutions      int      `json:"resolutions"`
-	TotalResolutions int      `json:"totalResolutions"`
-	Progress         float64  `json:"progress"`
+	Resolutions      int      `json:"resolutions"`      // готовые разрешения
+	TotalResolutions int      `json:"totalResolutions"` // всего разрешений
+	Progress         float64  `json:"progress"`         // общий процент по всем этапам
 	Size             []string `json:"size"`
+	Stage            string   `json:"stage"`
+	Step             int      `json:"step"` // номер текущего этапа с единицы
+	Steps            int      `json:"steps"`
+	StepProgress     float64  `json:"stepProgress"` // процент текущего этапа
+	Speed            float64  `json:"speed"`        // скорость кодирования относительно реального времени
+	Fps              float64  `json:"fps"`
+	Eta              float64  `json:"eta"` // оставшееся время задания в секундах
+}
+
+// Stage этап задания, Weight — ожидаемая стоимость относительно кодирования 1080p
+type Stage struct {
+	Name   string
+	Weight float64
+	Size   []string // разрешение для этапов кодирования
+}
+
+var (
+	NormalizeStage = Stage{Name: "normalize", Weight: 1.5}
+	LoudnessStage  = Stage{Name: "loudness", Weight: 0.05}
+)
+
+// EncodeStage этап кодирования разрешения, стоимость пропорциональна числу пикселей
+func EncodeStage(resolution string) Stage {
+	parts := strings.Split(resolution, "x")
+	weight := 1.0
+	if len(parts) == 2 {
+		width, _ := strconv.Atoi(parts[0])
+		height, _ := strconv.Atoi(parts[1])
+		weight = math.Max(float64(width*height)/(1920*1080), 0.05)
+	}
+	return Stage{Name: "encode " + resolution, Weight: weight, Size: parts}
+}
+
+// Tracker сводит прогресс всех этапов задания в один процент и отправляет его в WebSocket.
+// Методы можно вызывать у nil: тогда команды выполняются без отчета
+type Tracker struct {
+	conn    *websocket.Conn
+	stages  []Stage
+	total   float64
+	done    map[string]bool
+	started time.Time
+}
+
+func NewTracker(conn *websocket.Conn, stages ...Stage) *Tracker {
+	t := &Tracker{conn: conn, stages: stages, done: map[string]bool{}, started: time.Now()}
+	for _, stage := range stages {
+		t.total += stage.Weight
+	}
+	return t
+}
+
+// Complete отмечает этап выполненным, в том числе пропущенный
+func (t *Tracker) Complete(name string) {
+	if t == nil {
+		return
+	}
+	t.done[name] = true
+	t.send(name, 100, encodeStats{})
+}
+
+// encodeStats показатели из вывода ffmpeg -progress
+type encodeStats struct {
+	outTime float64
+	speed   float64
+	fps     float64
+}
+
+// Run выполняет ffmpeg как этап name, duration — длительность входа в секундах для процента этапа
+func (t *Tracker) Run(name string, duration float64, args ...string) error {
+	if t == nil {
+		return runFFmpeg(args...)
+	}
+
+	args = append([]string{"-nostats", "-progress", "pipe:1"}, args...)
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Вывод идет блоками key=value, каждый блок заканчивается строкой progress=continue или progress=end
+	stats := encodeStats{}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "out_time_us":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				stats.outTime = float64(us) / 1e6
+			}
+		case "fps":
+			stats.fps, _ = strconv.ParseFloat(value, 64)
+		case "speed":
+			stats.speed, _ = strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "x"), 64)
+		case "progress":
+			step := 0.0
+			if duration > 0 {
+				step = math.Min(stats.outTime/duration*100, 100)
+			}
+			if value == "end" {
+				step = 100
+			}
+			t.send(name, step, stats)
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg command failed: %v, %v", err, stderr.String())
+	}
+	t.done[name] = true
+	return nil
+}
+
+// send отправляет сводный прогресс; ETA считается по прошедшему времени и доле выполненной работы
+func (t *Tracker) send(name string, step float64, stats encodeStats) {
+	index := -1
+	completed := 0.0
+	result := ProgressData{Success: true, Stage: name, StepProgress: step, Steps: len(t.stages), Speed: stats.speed, Fps: stats.fps}
+	for i, stage := range t.stages {
+		if stage.Size != nil {
+			result.TotalResolutions++
+		}
+		if t.done[stage.Name] {
+			completed += stage.Weight
+			if stage.Size != nil {
+				result.Resolutions++
+			}
+		}
+		if stage.Name == name {
+			index = i
+		}
+	}
+	if index < 0 || t.total <= 0 {
+		return
+	}
+
+	stage := t.stages[index]
+	if !t.done[name] {
+		completed += stage.Weight * step / 100
+	}
+	result.Step = index + 1
+	result.Size = stage.Size
+	result.Progress = completed / t.total * 100
+	if result.Progress > 0 {
+		elapsed := time.Since(t.started).Seconds()
+		result.Eta = elapsed * (100 - result.Progress) / result.Progress
+	}
+
+	fmt.Println(result)
+	if t.conn == nil {
+		return
+	}
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Error sending progress message: %v", err)
+		return
+	}
+	if err := t.conn.WriteMessage(websocket.TextMessage, bytes); err != nil {
+		log.Printf("Error sending progress message: %v", err)
+	}
 }
 
 func CreatFramesVideo(inputFilePath string, conn *websocket.Conn, folder string) error {
@@ -74,12 +248,26 @@ func getFrameCount(videoPath string) (int, error) {
 }
 
 func GetAspectRatio(videoFile string) (aspectRatio float64, err error) {
+	width, height, err := VideoSize(videoFile)
+	if err != nil {
+		return 0, err
+	}
+
+	// Вычисление соотношения сторон
+	aspectRatio = float64(width) / float64(height)
+
+	return
+
+}
+
+// VideoSize возвращает ширину и высоту кадра первой видеодорожки
+func VideoSize(videoFile string) (width, height int, err error) {
 	// Команда для вызова ffprobe и получения ширины и высоты видео
 	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=width,height", "-of", "csv=s=x:p=0", videoFile)
 	output, err := cmd.Output()
 	if err != nil {
 		fmt.Println("Ошибка выполнения команды ffprobe:", err)
-		return 0, err
+		return 0, 0, err
 	}
 
 	// Парсинг результата
@@ -87,166 +275,1221 @@ func GetAspectRatio(videoFile string) (aspectRatio float64, err error) {
 	dimensions := strings.Split(result, "x")
 	if len(dimensions) != 2 {
 		fmt.Println("Не удалось получить ширину и высоту видео")
-		return 0, err
+		return 0, 0, fmt.Errorf("unexpected ffprobe output: %q", result)
 	}
 
-	width, err := strconv.Atoi(dimensions[0])
+	width, err = strconv.Atoi(dimensions[0])
 	if err != nil {
 		fmt.Println("Ошибка парсинга ширины:", err)
+		return 0, 0, err
+	}
+
+	height, err = strconv.Atoi(dimensions[1])
+	if err != nil {
+		fmt.Println("Ошибка парсинга высоты:", err)
+		return 0, 0, err
+	}
+	if width == 0 || height == 0 {
+		return 0, 0, fmt.Errorf("invalid video size %dx%d", width, height)
+	}
+
+	return width, height, nil
+}
+
+// StreamInfo свойства видеодорожки, влияющие на нормализацию
+type StreamInfo struct {
+	Width          int    `json:"width" firestore:"width"`
+	Height         int    `json:"height" firestore:"height"`
+	Rotation       int    `json:"rotation" firestore:"rotation"` // поворот по часовой стрелке для показа: 0, 90, 180, 270
+	FieldOrder     string `json:"fieldOrder" firestore:"fieldOrder"`
+	ColorTransfer  string `json:"colorTransfer" firestore:"colorTransfer"`
+	ColorPrimaries string `json:"colorPrimaries" firestore:"colorPrimaries"`
+	PixFmt         string `json:"pixFmt" firestore:"pixFmt"`
+	FrameRate      string `json:"frameRate" firestore:"frameRate"`       // r_frame_rate
+	AvgFrameRate   string `json:"avgFrameRate" firestore:"avgFrameRate"` // avg_frame_rate
+}
+
+// DisplaySize размер кадра при показе: ffmpeg по умолчанию поворачивает кадр при декодировании
+func (info StreamInfo) DisplaySize() (int, int) {
+	if info.Rotation == 90 || info.Rotation == 270 {
+		return info.Height, info.Width
+	}
+	return info.Width, info.Height
+}
+
+// probeOutput вывод ffprobe -show_streams в JSON
+type probeOutput struct {
+	Streams []struct {
+		Width          int               `json:"width"`
+		Height         int               `json:"height"`
+		FieldOrder     string            `json:"field_order"`
+		ColorTransfer  string            `json:"color_transfer"`
+		ColorPrimaries string            `json:"color_primaries"`
+		PixFmt         string            `json:"pix_fmt"`
+		RFrameRate     string            `json:"r_frame_rate"`
+		AvgFrameRate   string            `json:"avg_frame_rate"`
+		Tags           map[string]string `json:"tags"`
+		SideDataList   []struct {
+			Rotation float64 `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+}
+
+// ProbeVideo читает свойства первой видеодорожки
+func ProbeVideo(videoFile string) (StreamInfo, error) {
+	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0", "-show_streams", "-of", "json", videoFile)
+	output, err := cmd.Output()
+	if err != nil {
+		return StreamInfo{}, fmt.Errorf("ошибка при выполнении ffprobe: %v", err)
+	}
+
+	var probe probeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return StreamInfo{}, err
+	}
+	if len(probe.Streams) == 0 {
+		return StreamInfo{}, fmt.Errorf("no video stream in %s", videoFile)
+	}
+	stream := probe.Streams[0]
+
+	info := StreamInfo{
+		Width:          stream.Width,
+		Height:         stream.Height,
+		FieldOrder:     stream.FieldOrder,
+		ColorTransfer:  stream.ColorTransfer,
+		ColorPrimaries: stream.ColorPrimaries,
+		PixFmt:         stream.PixFmt,
+		FrameRate:      stream.RFrameRate,
+		AvgFrameRate:   stream.AvgFrameRate,
+	}
+
+	// Старые файлы хранят поворот в теге rotate, новые — в матрице отображения (против часовой стрелки)
+	rotation := 0
+	if value, ok := stream.Tags["rotate"]; ok {
+		rotation, _ = strconv.Atoi(value)
+	}
+	for _, data := range stream.SideDataList {
+		if data.Rotation != 0 {
+			rotation = -int(math.Round(data.Rotation))
+		}
+	}
+	info.Rotation = ((rotation % 360) + 360) % 360
+
+	return info, nil
+}
+
+// Interlaced кадры с чересстрочной разверткой
+func (i StreamInfo) Interlaced() bool {
+	switch i.FieldOrder {
+	case "tt", "bb", "tb", "bt":
+		return true
+	}
+	return false
+}
+
+// Rate средняя частота кадров, иначе базовая
+func (i StreamInfo) Rate() float64 {
+	if rate := parseRate(i.AvgFrameRate); rate > 0 {
+		return rate
+	}
+	return parseRate(i.FrameRate)
+}
+
+// HDR передаточная функция PQ (HDR10, Dolby Vision) или HLG
+func (i StreamInfo) HDR() bool {
+	return i.ColorTransfer == "smpte2084" || i.ColorTransfer == "arib-std-b67"
+}
+
+// parseRate разбирает частоту кадров вида 30000/1001
+func parseRate(rate string) float64 {
+	parts := strings.Split(rate, "/")
+	numerator, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0
+	}
+	if len(parts) == 2 {
+		denominator, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || denominator == 0 {
+			return 0
+		}
+		return numerator / denominator
+	}
+	return numerator
+}
+
+// standardRates частоты кадров, к которым приводится переменная частота
+var standardRates = []float64{24, 25, 30, 50, 60}
+
+// VariableFrameRate частота кадров плавает: средняя заметно отличается от базовой
+func (i StreamInfo) VariableFrameRate() bool {
+	r, avg := parseRate(i.FrameRate), parseRate(i.AvgFrameRate)
+	return r > 0 && avg > 0 && math.Abs(r-avg)/r > 0.01
+}
+
+// ConstantFrameRate ближайшая стандартная частота к средней частоте кадров
+func (i StreamInfo) ConstantFrameRate() float64 {
+	avg := parseRate(i.AvgFrameRate)
+	best := standardRates[2]
+	for _, rate := range standardRates {
+		if math.Abs(rate-avg) < math.Abs(best-avg) {
+			best = rate
+		}
+	}
+	return best
+}
+
+// Normalization что было исправлено при нормализации исходника
+type Normalization struct {
+	Probe       StreamInfo `json:"probe" firestore:"probe"`
+	Rotated     int        `json:"rotated" firestore:"rotated"`
+	Deinterlace string     `json:"deinterlace" firestore:"deinterlace"`
+	ToneMapped  bool       `json:"toneMapped" firestore:"toneMapped"`
+	FrameRate   float64    `json:"frameRate" firestore:"frameRate"` // постоянная частота, 0 — не менялась
+}
+
+// Applied нормализация изменила видео
+func (n Normalization) Applied() bool {
+	return n.Rotated != 0 || n.Deinterlace != "" || n.ToneMapped || n.FrameRate > 0
+}
+
+// toneMapFilter переводит HDR (PQ/HLG) в SDR BT.709
+var toneMapFilter = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv"
+
+// NormalizeVideo приводит исходник к виду, с которым работают рендиции: поворот применяется к кадрам,
+// чересстрочная развертка убирается (deinterlacer — bwdif или yadif), HDR переводится в SDR BT.709,
+// переменная частота кадров — в постоянную. Если исправлять нечего, файл не создается
+func NormalizeVideo(inputFile, outputFile, deinterlacer string, progress *Tracker) (Normalization, error) {
+	info, err := ProbeVideo(inputFile)
+	if err != nil {
+		return Normalization{}, err
+	}
+	result := Normalization{Probe: info}
+
+	filters := []string{}
+	if info.Interlaced() {
+		if deinterlacer != "yadif" {
+			deinterlacer = "bwdif"
+		}
+		filters = append(filters, deinterlacer+"=mode=send_frame:parity=auto:deint=all")
+		result.Deinterlace = deinterlacer
+	}
+	// Поворот применяет автоповорот ffmpeg при декодировании, он же убирает матрицу поворота из результата
+	result.Rotated = info.Rotation
+	if info.HDR() {
+		if HasFilter("zscale") && HasFilter("tonemap") {
+			filters = append(filters, toneMapFilter)
+			result.ToneMapped = true
+		} else {
+			fmt.Printf("ffmpeg собран без zscale, HDR %v не будет переведен в SDR\n", inputFile)
+		}
+	}
+	if info.VariableFrameRate() {
+		result.FrameRate = info.ConstantFrameRate()
+		filters = append(filters, fmt.Sprintf("fps=%g", result.FrameRate))
+	}
+	if !result.Applied() {
+		progress.Complete(NormalizeStage.Name)
+		return result, nil
+	}
+	filters = append(filters, "format=yuv420p")
+
+	args := []string{"-y", "-i", inputFile, "-map", "0:v:0", "-map", "0:a?", "-vf", strings.Join(filters, ","),
+		"-c:v", "libx264", "-preset", "fast", "-crf", "16"}
+	if result.ToneMapped {
+		args = append(args, "-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709")
+	}
+	if result.FrameRate > 0 {
+		args = append(args, "-fps_mode", "cfr")
+	}
+	args = append(args, "-c:a", "aac", "-b:a", "256k", "-movflags", "+faststart", outputFile)
+	duration := 0.0
+	if progress != nil {
+		duration, _ = getVideoDurationInSeconds(inputFile)
+	}
+	if err := progress.Run(NormalizeStage.Name, duration, args...); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// Chapter глава для встраивания в MP4
+type Chapter struct {
+	Start float64
+	End   float64
+	Title string
+}
+
+// EncodeOptions дополнительные параметры кодирования
+type EncodeOptions struct {
+	Chapters []Chapter
+	Audio    *AudioOptions
+	Loudness *LoudnessStats // результат первого прохода loudnorm
+	// Звук вынесен в отдельные аудио-рендиции, сегменты видео без звука
+	VideoOnly bool
+	Codec     string // h264 (по умолчанию), hevc или av1
+	// Битрейт видео для H.264 в бит/с из лестницы под контент, 0 — качество по умолчанию
+	Bitrate   int
+	Watermark *Watermark
+	Hash      string   // хеш для имен файлов, по умолчанию хеш входного файла
+	Progress  *Tracker // общий прогресс задания, если кодирование — один из этапов
+}
+
+// Watermark водяной знак (логотип) поверх видео
+type Watermark struct {
+	Image    string  `json:"image" firestore:"image"`       // путь к изображению в Firestorage
+	Position string  `json:"position" firestore:"position"` // top-left, top-right, bottom-left, bottom-right (по умолчанию), center
+	Opacity  float64 `json:"opacity" firestore:"opacity"`   // непрозрачность от 0 до 1, по умолчанию 0.8
+	Scale    float64 `json:"scale" firestore:"scale"`       // ширина логотипа относительно ширины кадра, по умолчанию 0.15
+	Margin   int     `json:"margin" firestore:"margin"`     // отступ от края в пикселях, по умолчанию 20
+	Moving   bool    `json:"moving" firestore:"moving"`     // логотип переходит по углам кадра
+	Interval float64 `json:"interval" firestore:"interval"` // период смены угла в секундах, по умолчанию 10
+
+	File string `json:"-" firestore:"-"` // локальная копия изображения
+}
+
+func (w Watermark) withDefaults() Watermark {
+	if w.Opacity <= 0 || w.Opacity > 1 {
+		w.Opacity = 0.8
+	}
+	if w.Scale <= 0 || w.Scale > 1 {
+		w.Scale = 0.15
+	}
+	if w.Margin <= 0 {
+		w.Margin = 20
+	}
+	if w.Interval <= 0 {
+		w.Interval = 10
+	}
+	if w.Position == "" {
+		w.Position = "bottom-right"
+	}
+	return w
+}
+
+// overlayPosition выражения x и y фильтра overlay
+func (w Watermark) overlayPosition() (string, string) {
+	left, top := strconv.Itoa(w.Margin), strconv.Itoa(w.Margin)
+	right, bottom := fmt.Sprintf("W-w-%d", w.Margin), fmt.Sprintf("H-h-%d", w.Margin)
+	if w.Moving {
+		// Угол меняется каждые Interval секунд по кругу: верх-лево, верх-право, низ-право, низ-лево
+		corner := fmt.Sprintf("mod(floor(t/%g),4)", w.Interval)
+		return fmt.Sprintf("'if(between(%s,1,2),%s,%s)'", corner, right, left), fmt.Sprintf("'if(gte(%s,2),%s,%s)'", corner, bottom, top)
+	}
+	switch w.Position {
+	case "top-left":
+		return left, top
+	case "top-right":
+		return right, top
+	case "bottom-left":
+		return left, bottom
+	case "center":
+		return "(W-w)/2", "(H-h)/2"
+	default:
+		return right, bottom
+	}
+}
+
+// filter граф фильтров: масштабирование кадра до width x height и наложение логотипа из входа input.
+// Результат — поток [v]
+func (w Watermark) filter(width, height string, input int) (string, error) {
+	frameWidth, err := strconv.Atoi(width)
+	if err != nil {
+		return "", fmt.Errorf("неверная ширина кадра: %s", width)
+	}
+	w = w.withDefaults()
+	x, y := w.overlayPosition()
+	logoWidth := max(int(float64(frameWidth)*w.Scale), 1)
+	return fmt.Sprintf("[0:v]scale=%s:%s[base];[%d:v]scale=%d:-1,format=rgba,colorchannelmixer=aa=%g[wm];[base][wm]overlay=x=%s:y=%s[v]",
+		width, height, input, logoWidth, w.Opacity, x, y), nil
+}
+
+// videoCodec параметры кодека для сегментов HLS
+type videoCodec struct {
+	args       []string
+	codecs     string       // значение для атрибута CODECS; с уровнями — шаблон, куда подставляется уровень
+	levels     []codecLevel // уровни по возрастанию, пусто — уровень задан в args
+	fmp4       bool         // HEVC и AV1 в HLS передаются в fragmented MP4
+	efficiency float64      // доля битрейта H.264 при сопоставимом качестве
+}
+
+// codecLevel ограничения уровня кодека: площадь кадра, отсчетов яркости в секунду и битрейт (Main tier)
+type codecLevel struct {
+	name        string
+	pictureSize float64
+	sampleRate  float64
+	bitrate     int
+}
+
+// Уровни HEVC (ITU-T H.265, таблица A.8); в CODECS пишется уровень, умноженный на 30
+var hevcLevels = []codecLevel{
+	{"90", 552960, 16588800, 6000000},
+	{"93", 983040, 33177600, 10000000},
+	{"120", 2228224, 66846720, 12000000},
+	{"123", 2228224, 133693440, 20000000},
+	{"150", 8912896, 267386880, 25000000},
+	{"153", 8912896, 534773760, 40000000},
+	{"156", 8912896, 1069547520, 60000000},
+	{"180", 35651584, 1069547520, 60000000},
+	{"183", 35651584, 2139095040, 120000000},
+	{"186", 35651584, 4278190080, 240000000},
+}
+
+// Уровни AV1 (спецификация AV1, приложение A.3); в CODECS пишется seq_level_idx
+var av1Levels = []codecLevel{
+	{"00", 147456, 4423680, 1500000},
+	{"01", 278784, 8363520, 3000000},
+	{"04", 665856, 19975680, 6000000},
+	{"05", 1065024, 31950720, 10000000},
+	{"08", 2359296, 70778880, 12000000},
+	{"09", 2359296, 141557760, 20000000},
+	{"12", 8912896, 267386880, 30000000},
+	{"13", 8912896, 534773760, 40000000},
+	{"14", 8912896, 1069547520, 60000000},
+	{"16", 35651584, 1069547520, 60000000},
+	{"17", 35651584, 2139095040, 100000000},
+	{"18", 35651584, 4278190080, 160000000},
+}
+
+// Кодеки видео; H.264 остается запасным вариантом для всех плееров
+var (
+	CodecH264 = "h264"
+	CodecHEVC = "hevc"
+	CodecAV1  = "av1"
+
+	videoCodecs = map[string]videoCodec{
+		CodecH264: {
+			args:       []string{"-c:v", "libx264", "-profile:v", "baseline", "-level", "3.0"},
+			codecs:     "avc1.42e01e",
+			efficiency: 1,
+		},
+		CodecHEVC: {
+			args:       []string{"-c:v", "libx265", "-tag:v", "hvc1", "-pix_fmt", "yuv420p", "-x265-params", "log-level=error"},
+			codecs:     "hvc1.1.6.L%s.90",
+			levels:     hevcLevels,
+			fmp4:       true,
+			efficiency: 0.6,
+		},
+		CodecAV1: {
+			args:       []string{"-c:v", "libsvtav1", "-preset", "8", "-pix_fmt", "yuv420p"},
+			codecs:     "av01.0.%sM.08",
+			levels:     av1Levels,
+			fmp4:       true,
+			efficiency: 0.5,
+		},
+	}
+)
+
+// CodecsString значение атрибута CODECS для кодека видео с уровнем кадра 1920x1080 при 30 кадрах в секунду
+func CodecsString(codec string) (string, error) {
+	return CodecsFor(codec, "1920x1080", 30, 0)
+}
+
+// CodecsFor значение атрибута CODECS для рендиции: уровень кодека — наименьший, в который
+// укладываются разрешение, частота кадров и пиковый битрейт (бит/с, 0 — не учитывается)
+func CodecsFor(codec, resolution string, frameRate float64, bitrate int) (string, error) {
+	if codec == "" {
+		codec = CodecH264
+	}
+	c, ok := videoCodecs[codec]
+	if !ok {
+		return "", fmt.Errorf("unsupported codec: %s", codec)
+	}
+	if len(c.levels) == 0 {
+		return c.codecs, nil
+	}
+
+	var width, height int
+	if _, err := fmt.Sscanf(resolution, "%dx%d", &width, &height); err != nil {
+		return "", fmt.Errorf("неверный формат разрешения: %s", resolution)
+	}
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+	pictureSize := float64(width * height)
+	level := c.levels[len(c.levels)-1]
+	for _, l := range c.levels {
+		if pictureSize <= l.pictureSize && pictureSize*frameRate <= l.sampleRate && bitrate <= l.bitrate {
+			level = l
+			break
+		}
+	}
+	return fmt.Sprintf(c.codecs, level.name), nil
+}
+
+// AudioOptions нормализация громкости (EBU R128) и очистка звука
+type AudioOptions struct {
+	Normalize      bool    `json:"normalize"`
+	TargetLUFS     float64 `json:"targetLufs"`     // целевая интегральная громкость, по умолчанию -16
+	TruePeak       float64 `json:"truePeak"`       // максимальный истинный пик в dBTP, по умолчанию -1.5
+	LRA            float64 `json:"lra"`            // диапазон громкости, по умолчанию 11
+	HighPass       float64 `json:"highPass"`       // частота среза фильтра высоких частот в Гц, 0 — выключен
+	Denoise        bool    `json:"denoise"`        // подавление шума afftdn
+	NoiseReduction float64 `json:"noiseReduction"` // сила подавления шума в дБ, по умолчанию 12
+}
+
+func (o AudioOptions) withDefaults() AudioOptions {
+	if o.TargetLUFS == 0 {
+		o.TargetLUFS = -16
+	}
+	if o.TruePeak == 0 {
+		o.TruePeak = -1.5
+	}
+	if o.LRA == 0 {
+		o.LRA = 11
+	}
+	if o.NoiseReduction == 0 {
+		o.NoiseReduction = 12
+	}
+	return o
+}
+
+// Enabled возвращает true, если звук нужно перекодировать с фильтрами
+func (o *AudioOptions) Enabled() bool {
+	return o != nil && (o.Normalize || o.HighPass > 0 || o.Denoise)
+}
+
+// cleanupFilters фильтры очистки звука, которые идут перед loudnorm
+func (o AudioOptions) cleanupFilters() []string {
+	filters := []string{}
+	if o.HighPass > 0 {
+		filters = append(filters, fmt.Sprintf("highpass=f=%g", o.HighPass))
+	}
+	if o.Denoise {
+		filters = append(filters, fmt.Sprintf("afftdn=nr=%g", o.NoiseReduction))
+	}
+	return filters
+}
+
+// LoudnessStats измеренная громкость звука
+type LoudnessStats struct {
+	InputI            float64 `json:"inputI" firestore:"inputI"`
+	InputTP           float64 `json:"inputTp" firestore:"inputTp"`
+	InputLRA          float64 `json:"inputLra" firestore:"inputLra"`
+	InputThresh       float64 `json:"inputThresh" firestore:"inputThresh"`
+	TargetOffset      float64 `json:"targetOffset" firestore:"targetOffset"`
+	TargetLUFS        float64 `json:"targetLufs" firestore:"targetLufs"`
+	NormalizationType string  `json:"normalizationType" firestore:"normalizationType"`
+}
+
+// loudnormOutput вывод loudnorm с print_format=json (числа передаются строками)
+type loudnormOutput struct {
+	InputI            string `json:"input_i"`
+	InputTP           string `json:"input_tp"`
+	InputLRA          string `json:"input_lra"`
+	InputThresh       string `json:"input_thresh"`
+	TargetOffset      string `json:"target_offset"`
+	NormalizationType string `json:"normalization_type"`
+}
+
+// MeasureLoudness первый проход loudnorm: измеряет громкость звука после фильтров очистки
+func MeasureLoudness(inputFile string, opts AudioOptions) (*LoudnessStats, error) {
+	opts = opts.withDefaults()
+	filters := append(opts.cleanupFilters(), fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g:print_format=json", opts.TargetLUFS, opts.TruePeak, opts.LRA))
+
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-nostats", "-i", inputFile, "-vn", "-af", strings.Join(filters, ","), "-f", "null", "-")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg command failed: %v, %v", err, stderr.String())
+	}
+
+	// JSON печатается последним блоком в stderr
+	output := stderr.String()
+	start := strings.LastIndex(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start == -1 || end < start {
+		return nil, fmt.Errorf("loudnorm output not found")
+	}
+	var measured loudnormOutput
+	if err := json.Unmarshal([]byte(output[start:end+1]), &measured); err != nil {
+		return nil, fmt.Errorf("invalid loudnorm output: %v", err)
+	}
+
+	stats := &LoudnessStats{TargetLUFS: opts.TargetLUFS, NormalizationType: measured.NormalizationType}
+	for _, field := range []struct {
+		value string
+		dest  *float64
+	}{
+		{measured.InputI, &stats.InputI},
+		{measured.InputTP, &stats.InputTP},
+		{measured.InputLRA, &stats.InputLRA},
+		{measured.InputThresh, &stats.InputThresh},
+		{measured.TargetOffset, &stats.TargetOffset},
+	} {
+		value, err := strconv.ParseFloat(field.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid loudnorm value %q: %v", field.value, err)
+		}
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			return nil, fmt.Errorf("audio track is silent")
+		}
+		*field.dest = value
+	}
+
+	return stats, nil
+}
+
+// AudioFilter строит цепочку фильтров второго прохода с измеренными значениями
+func AudioFilter(opts AudioOptions, stats *LoudnessStats) string {
+	opts = opts.withDefaults()
+	filters := opts.cleanupFilters()
+	if opts.Normalize {
+		loudnorm := fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g", opts.TargetLUFS, opts.TruePeak, opts.LRA)
+		if stats != nil {
+			loudnorm += fmt.Sprintf(":measured_I=%g:measured_TP=%g:measured_LRA=%g:measured_thresh=%g:offset=%g:linear=true",
+				stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.TargetOffset)
+		}
+		filters = append(filters, loudnorm)
+	}
+	return strings.Join(filters, ",")
+}
+
+// audioArgs параметры кодирования звука; loudnorm повышает частоту дискретизации, поэтому она задается явно
+func (o EncodeOptions) audioArgs(fallback ...string) []string {
+	if !o.Audio.Enabled() {
+		return fallback
+	}
+	return []string{"-af", AudioFilter(*o.Audio, o.Loudness), "-c:a", "aac", "-b:a", "192k", "-ar", "48000"}
+}
+
+// WriteFFMetadata записывает главы в формате ffmetadata
+func WriteFFMetadata(chapters []Chapter, path string) error {
+	escape := strings.NewReplacer("\\", "\\\\", "=", "\\=", ";", "\\;", "#", "\\#", "\n", "\\\n")
+
+	var b strings.Builder
+	b.WriteString(";FFMETADATA1\n")
+	for _, chapter := range chapters {
+		fmt.Fprintf(&b, "\n[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n", int64(chapter.Start*1000), int64(chapter.End*1000), escape.Replace(chapter.Title))
+	}
+
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+func ConvertVideo(inputFilePath string, resolutions []string, conn *websocket.Conn, opts EncodeOptions) error {
+	duration, err := getVideoDurationInSeconds(inputFilePath)
+	if err != nil {
+		log.Println("Ошибка при получении продолжительности видео:", err)
+		return err
+	}
+
+	// Хеш исходного файла, если на вход подан нормализованный
+	hash := opts.Hash
+	if hash == "" {
+		hash, err = method.GenerateFileHash(inputFilePath)
+		if err != nil {
+			log.Println("Ошибка при генерации хеша файла:", err)
+			return err
+		}
+	}
+
+	// Без общего задания прогресс считается только по разрешениям
+	progress := opts.Progress
+	if progress == nil {
+		stages := []Stage{}
+		for _, resolution := range resolutions {
+			stages = append(stages, EncodeStage(resolution))
+		}
+		progress = NewTracker(conn, stages...)
+	}
+
+	for _, resolution := range resolutions {
+		parts := strings.Split(resolution, "x")
+		if len(parts) != 2 {
+			return fmt.Errorf("неверный формат разрешения: %s", resolution)
+		}
+
+		width := parts[0]
+		height := parts[1]
+		outputDirName := "output"
+
+		outputFileName := fmt.Sprintf("%s/%s_%s_%s.mp4", outputDirName, hash, width, height)
+
+		args := []string{}
+		inputs := 0
+		addInput := func(input ...string) int {
+			args = append(args, input...)
+			inputs++
+			return inputs - 1
+		}
+		addInput("-i", inputFilePath)
+
+		chapters, metadataFile := -1, ""
+		if len(opts.Chapters) > 0 {
+			metadataFile = fmt.Sprintf("%s/%s_chapters.txt", outputDirName, hash)
+			if err := WriteFFMetadata(opts.Chapters, metadataFile); err != nil {
+				return err
+			}
+			chapters = addInput("-i", metadataFile)
+		}
+
+		// Водяной знак подключается последним входом, масштабирование идет в том же графе
+		video := "0:v"
+		if opts.Watermark != nil {
+			filter, err := opts.Watermark.filter(width, height, addInput("-i", opts.Watermark.File))
+			if err != nil {
+				if metadataFile != "" {
+					os.Remove(metadataFile)
+				}
+				return err
+			}
+			args = append(args, "-filter_complex", filter)
+			video = "[v]"
+		}
+		if opts.Watermark != nil || len(opts.Chapters) > 0 {
+			args = append(args, "-map", video, "-map", "0:a?")
+		}
+		if chapters >= 0 {
+			args = append(args, "-map_metadata", strconv.Itoa(chapters), "-map_chapters", strconv.Itoa(chapters))
+		}
+		if opts.Watermark == nil {
+			args = append(args, "-vf", fmt.Sprintf("scale=%s:%s", width, height))
+		}
+		args = append(args, opts.audioArgs("-c:a", "copy")...)
+		args = append(args, outputFileName)
+
+		err := progress.Run(EncodeStage(resolution).Name, duration, args...)
+		// Файл глав нужен только на время кодирования этого разрешения
+		if metadataFile != "" {
+			os.Remove(metadataFile)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Видео конвертировано в разрешение %s\n", resolution)
+	}
+
+	return nil
+}
+
+// Variant вариант потока в мастер-манифесте
+type Variant struct {
+	Resolution string `json:"resolution" firestore:"resolution"`
+	Uri        string `json:"uri" firestore:"uri"`
+	Bandwidth  int    `json:"bandwidth" firestore:"bandwidth"`
+	Codec      string `json:"codec" firestore:"codec"`
+	Codecs     string `json:"codecs" firestore:"codecs"` // атрибут CODECS, например avc1.42e01e
+	// Сегменты без звука: звук только в аудио-рендициях или его нет в исходнике
+	VideoOnly bool `json:"videoOnly" firestore:"videoOnly"`
+}
+
+// MediaRendition альтернативная дорожка #EXT-X-MEDIA (субтитры, аудио)
+type MediaRendition struct {
+	Type       string `json:"type" firestore:"type"`
+	GroupId    string `json:"groupId" firestore:"groupId"`
+	Language   string `json:"language" firestore:"language"`
+	Name       string `json:"name" firestore:"name"`
+	Uri        string `json:"uri" firestore:"uri"`
+	Default    bool   `json:"default" firestore:"default"`
+	AutoSelect bool   `json:"autoselect" firestore:"autoselect"`
+}
+
+// SessionData тег #EXT-X-SESSION-DATA
+type SessionData struct {
+	DataId   string
+	Uri      string
+	Language string
+}
+
+// MasterPlaylist содержимое мастер-манифеста
+type MasterPlaylist struct {
+	Variants    []Variant
+	Subtitles   []MediaRendition
+	Audio       []MediaRendition
+	SessionData []SessionData
+}
+
+// ChaptersDataId идентификатор глав HLS (формат JSON Apple)
+var ChaptersDataId = "com.apple.hls.chapters"
+
+// hlsChapter глава в формате com.apple.hls.chapters
+type hlsChapter struct {
+	Chapter   int        `json:"chapter"`
+	StartTime float64    `json:"start-time"`
+	Duration  float64    `json:"duration"`
+	Titles    []hlsTitle `json:"titles"`
+}
+
+type hlsTitle struct {
+	Language string `json:"language"`
+	Title    string `json:"title"`
+}
+
+// WriteHLSChapters записывает главы в формате JSON для #EXT-X-SESSION-DATA
+func WriteHLSChapters(chapters []Chapter, language, path string) error {
+	list := make([]hlsChapter, len(chapters))
+	for i, chapter := range chapters {
+		list[i] = hlsChapter{
+			Chapter:   i + 1,
+			StartTime: chapter.Start,
+			Duration:  chapter.End - chapter.Start,
+			Titles:    []hlsTitle{{Language: language, Title: chapter.Title}},
+		}
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+var (
+	defaultBandwidth   = 2000000
+	SubtitlesGroupId   = "subs"
+	SubtitlesMediaType = "SUBTITLES"
+	AudioGroupId       = "audio"
+	AudioMediaType     = "AUDIO"
+	audioBitrate       = "128k"
+	AudioBandwidth     = 128000
+	audioCodecs        = "mp4a.40.2" // AAC-LC
+)
+
+// StorageUri кодирует путь к файлу для ссылки из манифеста в Firestorage
+func StorageUri(path string) string {
+	return strings.ReplaceAll(path, "/", "%2F") + "?alt=media"
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "YES"
+	}
+	return "NO"
+}
+
+// writeMedia записывает тег #EXT-X-MEDIA
+func writeMedia(file io.Writer, media MediaRendition) error {
+	attrs := []string{
+		"TYPE=" + media.Type,
+		fmt.Sprintf("GROUP-ID=%q", media.GroupId),
+	}
+	if media.Language != "" {
+		attrs = append(attrs, fmt.Sprintf("LANGUAGE=%q", media.Language))
+	}
+	attrs = append(attrs,
+		fmt.Sprintf("NAME=%q", media.Name),
+		"DEFAULT="+yesNo(media.Default),
+		"AUTOSELECT="+yesNo(media.AutoSelect || media.Default),
+	)
+	if media.Uri != "" {
+		attrs = append(attrs, fmt.Sprintf("URI=%q", media.Uri))
+	}
+	_, err := fmt.Fprintf(file, "#EXT-X-MEDIA:%s\n", strings.Join(attrs, ","))
+	return err
+}
+
+// WriteMasterM3U8 пишет мастер-манифест в w
+func WriteMasterM3U8(w io.Writer, master MasterPlaylist) error {
+	var err error
+	// Записываем заголовок файла манифеста
+	_, err = fmt.Fprintln(w, "#EXTM3U")
+	if err != nil {
+		return err
+	}
+
+	for _, data := range master.SessionData {
+		attrs := fmt.Sprintf("DATA-ID=%q,URI=%q", data.DataId, data.Uri)
+		if data.Language != "" {
+			attrs += fmt.Sprintf(",LANGUAGE=%q", data.Language)
+		}
+		if _, err := fmt.Fprintf(w, "#EXT-X-SESSION-DATA:%s\n", attrs); err != nil {
+			return err
+		}
+	}
+
+	// Дорожки субтитров и звука
+	for _, media := range append(append([]MediaRendition{}, master.Subtitles...), master.Audio...) {
+		if err := writeMedia(w, media); err != nil {
+			return err
+		}
+	}
+
+	// Добавляем информацию о каждом разрешении
+	for _, variant := range master.Variants {
+		bandwidth := variant.Bandwidth
+		if bandwidth == 0 {
+			bandwidth = defaultBandwidth
+		}
+		if len(master.Audio) > 0 {
+			bandwidth += AudioBandwidth
+		}
+		attrs := fmt.Sprintf("BANDWIDTH=%d,RESOLUTION=%s", bandwidth, variant.Resolution)
+		if codecs := variantCodecs(variant, len(master.Audio) > 0); codecs != "" {
+			attrs += fmt.Sprintf(",CODECS=%q", codecs)
+		}
+		if len(master.Audio) > 0 {
+			attrs += fmt.Sprintf(",AUDIO=%q", AudioGroupId)
+		}
+		if len(master.Subtitles) > 0 {
+			attrs += fmt.Sprintf(",SUBTITLES=%q", SubtitlesGroupId)
+		}
+		// Записываем информацию о начале потока для каждого разрешения
+		_, err = fmt.Fprintf(w, "#EXT-X-STREAM-INF:%s\n", attrs)
+		if err != nil {
+			return err
+		}
+		// Записываем ссылку на сегментный файл m3u8
+		_, err = fmt.Fprintf(w, "%s\n", variant.Uri)
+		if err != nil {
+			return err
+		}
+	}
+	// Вариант только со звуком для медленных сетей
+	if audio := defaultRendition(master.Audio); audio != nil {
+		_, err = fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=%q,AUDIO=%q\n%s\n", AudioBandwidth, audioCodecs, AudioGroupId, audio.Uri)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateMasterM3U8 создает мастер-файл манифеста M3U8 для различных разрешений
+func CreateMasterM3U8(filename string, master MasterPlaylist) error {
+	// Открываем файл для записи
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := WriteMasterM3U8(file, master); err != nil {
+		return err
+	}
+	fmt.Printf("Файл манифеста создан успешно: %v\n", filename)
+	if err := EditFile(filename); err != nil {
+		fmt.Printf("Ошибка редактирования файла маниыеста %v: %v\n", filename, err)
+	}
+
+	return nil
+}
+
+// variantCodecs атрибут CODECS варианта вместе с кодеком звука: из звуковой группы или из самих сегментов
+func variantCodecs(variant Variant, audio bool) string {
+	if variant.Codecs == "" {
+		return ""
+	}
+	if (audio || !variant.VideoOnly) && !strings.Contains(variant.Codecs, audioCodecs) {
+		return variant.Codecs + "," + audioCodecs
+	}
+	return variant.Codecs
+}
+
+// defaultRendition дорожка по умолчанию, иначе первая
+func defaultRendition(list []MediaRendition) *MediaRendition {
+	for i := range list {
+		if list[i].Default {
+			return &list[i]
+		}
+	}
+	if len(list) > 0 {
+		return &list[0]
+	}
+	return nil
+}
+
+// AudioTrack звуковая дорожка для отдельной аудио-рендиции
+type AudioTrack struct {
+	Name     string `json:"name"`
+	Language string `json:"language"`
+	Stream   int    `json:"stream"` // номер звуковой дорожки в файле
+	Source   string `json:"source"` // отдельный файл в Firestorage, если дорожки нет в исходном видео
+	Default  bool   `json:"default"`
+}
+
+// AudioStreams возвращает количество звуковых дорожек в файле
+func AudioStreams(filename string) (int, error) {
+	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "a", "-show_entries", "stream=index", "-of", "csv=p=0", filename)
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка при выполнении ffprobe: %v", err)
+	}
+	return len(strings.Fields(string(output))), nil
+}
+
+// CreateAudioSegments создает сегменты AAC без видео для одной звуковой дорожки
+func CreateAudioSegments(inputFile, outputPrefix string, stream int, opts EncodeOptions) error {
+	args := []string{"-i", inputFile, "-map", fmt.Sprintf("0:a:%d", stream), "-vn"}
+	args = append(args, opts.audioArgs("-c:a", "aac", "-ar", "48000")...)
+	args = append(args, "-b:a", audioBitrate, "-ac", "2", "-start_number", "0", "-hls_time", hlsTime, "-hls_list_size", "0", "-f", "hls", "-strftime_mkdir", "1", "-hls_segment_filename", outputPrefix+"%03d.ts", outputPrefix+".m3u8")
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	filePath := outputPrefix + ".m3u8"
+	fmt.Printf("Файл звуковых сегментов создан успешно: %v\n", filePath)
+	if err := EditFile(filePath); err != nil {
+		fmt.Printf("Ошибка редактирования файла сегмента %v: %v\n", filePath, err)
+	}
+
+	return nil
+}
+
+// createSegments создает сегменты видео из исходного файла с указанным разрешением
+func CreateSegments(inputFile, outputPrefix, resolution string, opts EncodeOptions) error {
+	if opts.Codec == "" {
+		opts.Codec = CodecH264
+	}
+	codec, ok := videoCodecs[opts.Codec]
+	if !ok {
+		return fmt.Errorf("unsupported codec: %s", opts.Codec)
+	}
+
+	args := []string{"-i", inputFile}
+	if opts.Watermark != nil {
+		args = append(args, "-i", opts.Watermark.File)
+	}
+	args = append(args, codec.args...)
+	if opts.Watermark != nil {
+		size := strings.Split(resolution, "x")
+		if len(size) != 2 {
+			return fmt.Errorf("неверный формат разрешения: %s", resolution)
+		}
+		filter, err := opts.Watermark.filter(size[0], size[1], 1)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-filter_complex", filter, "-map", "[v]")
+		if !opts.VideoOnly {
+			args = append(args, "-map", "0:a?")
+		}
+	} else {
+		args = append(args, "-s", resolution)
+	}
+	if opts.Bitrate > 0 {
+		// Ограничение VBV: пики до 1.5 битрейта, буфер на 2 секунды
+		bitrate := int(float64(opts.Bitrate) * codec.efficiency)
+		args = append(args, "-b:v", strconv.Itoa(bitrate), "-maxrate", strconv.Itoa(bitrate*3/2), "-bufsize", strconv.Itoa(bitrate*2))
+	}
+	if opts.VideoOnly {
+		args = append(args, "-an")
+	} else {
+		args = append(args, opts.audioArgs()...)
+	}
+	args = append(args, "-start_number", "0", "-hls_time", hlsTime, "-hls_list_size", "0", "-f", "hls", "-strftime_mkdir", "1")
+	if codec.fmp4 {
+		args = append(args, "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", filepath.Base(outputPrefix)+"init.mp4", "-hls_segment_filename", outputPrefix+"%03d.m4s")
+	} else {
+		args = append(args, "-hls_segment_filename", outputPrefix+"%v_%03d.ts")
+	}
+	args = append(args, outputPrefix+".m3u8")
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return err
+	}
+	filePath := outputPrefix + ".m3u8"
+	fmt.Printf("Файл сегмента создан успешно: %v\n", filePath)
+	if err := EditFile(filePath); err != nil {
+		fmt.Printf("Ошибка редактирования файла сегмента %v: %v\n", filePath, err)
+	}
+
+	return nil
+}
+
+// SegmentsBandwidth пиковый битрейт сегментов (бит/с) по размерам файлов с префиксом outputPrefix
+func SegmentsBandwidth(outputPrefix string) (int, error) {
+	files, err := filepath.Glob(outputPrefix + "*")
+	if err != nil {
 		return 0, err
 	}
-
-	height, err := strconv.Atoi(dimensions[1])
-	if err != nil {
-		fmt.Println("Ошибка парсинга высоты:", err)
-		return 0, err
+	duration := SegmentDuration()
+	peak := 0
+	for _, file := range files {
+		if ext := filepath.Ext(file); ext != ".ts" && ext != ".m4s" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return 0, err
+		}
+		if bandwidth := int(float64(info.Size()*8) / duration); bandwidth > peak {
+			peak = bandwidth
+		}
+	}
+	if peak == 0 {
+		return 0, fmt.Errorf("no segments found for %s", outputPrefix)
 	}
-
-	// Вычисление соотношения сторон
-	aspectRatio = float64(width) / float64(height)
-
-	return
-
+	return peak, nil
 }
 
-func ConvertVideo(inputFilePath string, resolutions []string, conn *websocket.Conn) error {
-	duration, err := getVideoDurationInSeconds(inputFilePath)
+// SegmentFiles возвращает файлы сегментов рендиции по порядку и init-файл для fMP4
+func SegmentFiles(outputPrefix, codec string) (segments []string, init string, err error) {
+	if codec == "" {
+		codec = CodecH264
+	}
+	c, ok := videoCodecs[codec]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported codec: %s", codec)
+	}
+	pattern := outputPrefix + "*.ts"
+	if c.fmp4 {
+		pattern = outputPrefix + "*.m4s"
+		init = outputPrefix + "init.mp4"
+	}
+	segments, err = filepath.Glob(pattern)
 	if err != nil {
-		log.Println("Ошибка при получении продолжительности видео:", err)
-		return err
+		return nil, "", err
 	}
+	sort.Strings(segments)
+	return segments, init, nil
+}
 
-	hash, err := method.GenerateFileHash(inputFilePath)
+// SegmentDurations длительности сегментов из #EXTINF медиа-плейлиста по порядку.
+// Сегменты режутся по ключевым кадрам, поэтому их длина отличается от hls_time
+func SegmentDurations(playlist string) ([]float64, error) {
+	file, err := os.Open(playlist)
 	if err != nil {
-		log.Println("Ошибка при генерации хеша файла:", err)
-		return err
+		return nil, err
 	}
+	defer file.Close()
 
-	for n, resolution := range resolutions {
-		parts := strings.Split(resolution, "x")
-		if len(parts) != 2 {
-			return fmt.Errorf("неверный формат разрешения: %s", resolution)
+	durations := []float64{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "#EXTINF:")
+		if !ok {
+			continue
 		}
+		duration, err := strconv.ParseFloat(strings.Split(value, ",")[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid #EXTINF in %s: %v", playlist, err)
+		}
+		durations = append(durations, duration)
+	}
+	return durations, scanner.Err()
+}
 
-		width := parts[0]
-		height := parts[1]
-		outputDirName := "output"
-
-		outputFileName := fmt.Sprintf("%s/%s_%s_%s.mp4", outputDirName, hash, width, height)
+// Quality оценки качества рендиции относительно исходника
+type Quality struct {
+	VMAF float64 `json:"vmaf,omitempty" firestore:"vmaf,omitempty"`
+	PSNR float64 `json:"psnr,omitempty" firestore:"psnr,omitempty"`
+	SSIM float64 `json:"ssim,omitempty" firestore:"ssim,omitempty"`
+}
 
-		cmd := exec.Command("ffmpeg", "-i", inputFilePath, "-vf", fmt.Sprintf("scale=%s:%s", width, height), "-c:a", "copy", outputFileName, "-progress", "-")
+var (
+	filtersOnce sync.Once
+	filters     = map[string]bool{}
 
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			return err
-		}
-		// stderr, err := cmd.StderrPipe()
-		// if err != nil {
-		// 	return err
-		// }
+	vmafPattern = regexp.MustCompile(`VMAF score: ([\d.]+)`)
+	psnrPattern = regexp.MustCompile(`PSNR .*average:([\d.]+|inf)`)
+	ssimPattern = regexp.MustCompile(`SSIM .*All:([\d.]+)`)
+)
 
-		err = cmd.Start()
+// HasFilter проверяет, есть ли фильтр в сборке ffmpeg
+func HasFilter(name string) bool {
+	filtersOnce.Do(func() {
+		output, err := exec.Command("ffmpeg", "-hide_banner", "-filters").Output()
 		if err != nil {
-			return err
+			return
 		}
-
-		scanner := bufio.NewScanner(stdout)
-
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.HasPrefix(line, "out_time=") {
-				timeStr := strings.Split(line, "=")[1]
-				currentTimeInSeconds, err := parseDuration(timeStr)
-				if err == nil {
-					progress := (currentTimeInSeconds / duration) * 100
-
-					result := ProgressData{
-						Success:          true,
-						Error:            "",
-						Resolutions:      len(resolutions),
-						TotalResolutions: n,
-						Progress:         progress,
-						Size:             parts,
-					}
-
-					fmt.Println(result)
-					bytes, err := json.Marshal(result)
-					if err != nil {
-						log.Printf("Error sending progress message: %v", err)
-						break
-					}
-
-					err = conn.WriteMessage(websocket.TextMessage, bytes)
-					if err != nil {
-						log.Printf("Error sending progress message: %v", err)
-						break
-					}
-				}
+		for _, line := range strings.Split(string(output), "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 {
+				filters[fields[1]] = true
 			}
 		}
+	})
+	return filters[name]
+}
 
-		err = cmd.Wait()
-		if err != nil {
-			return err
-		}
-		fmt.Printf("Видео конвертировано в разрешение %s\n", resolution)
-	}
-
-	return nil
+// HasVMAF проверяет, собран ли ffmpeg с libvmaf
+func HasVMAF() bool {
+	return HasFilter("libvmaf")
 }
 
-// createMasterM3U8 создает мастер-файл манифеста M3U8 для различных разрешений
-func CreateMasterM3U8(filename string, segments map[string]string) error {
-	// Открываем файл для записи
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+// CompareQuality сравнивает сегмент рендиции с тем же фрагментом исходника.
+// Оба видео масштабируются до 1920x1080 — разрешения модели VMAF по умолчанию.
+// Без libvmaf считаются PSNR и SSIM
+func CompareQuality(sourceFile, segmentFile string, start, duration float64) (Quality, error) {
+	scale := "scale=1920:1080:flags=bicubic,format=yuv420p,setpts=PTS-STARTPTS"
+	filter := fmt.Sprintf("[0:v]%s[dist];[1:v]%s[ref];", scale, scale)
+	vmaf := HasVMAF()
+	if vmaf {
+		filter += "[dist][ref]libvmaf"
+	} else {
+		filter += "[dist]split[dist1][dist2];[ref]split[ref1][ref2];[dist1][ref1]psnr;[dist2][ref2]ssim"
 	}
-	defer file.Close()
 
-	// Записываем заголовок файла манифеста
-	_, err = fmt.Fprintln(file, "#EXTM3U")
-	if err != nil {
-		return err
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-nostats", "-i", segmentFile,
+		"-ss", strconv.FormatFloat(start, 'f', 3, 64), "-t", strconv.FormatFloat(duration, 'f', 3, 64), "-i", sourceFile,
+		"-lavfi", filter, "-f", "null", "-")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Quality{}, fmt.Errorf("ffmpeg command failed: %v, %v", err, stderr.String())
 	}
 
-	// Добавляем информацию о каждом разрешении
-	for resolution, segmentFile := range segments {
-		// Записываем информацию о начале потока для каждого разрешения
-		_, err = fmt.Fprintf(file, "#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=%s\n", resolution)
-		if err != nil {
-			return err
+	output := stderr.String()
+	quality := Quality{}
+	parse := func(pattern *regexp.Regexp, dest *float64) error {
+		match := pattern.FindStringSubmatch(output)
+		if match == nil {
+			return fmt.Errorf("metric not found in ffmpeg output: %s", pattern)
 		}
-		// Записываем ссылку на сегментный файл m3u8
-		_, err = fmt.Fprintf(file, "%s\n", segmentFile)
-		if err != nil {
-			return err
+		if match[1] == "inf" {
+			// Кадры совпадают полностью
+			*dest = 100
+			return nil
 		}
+		value, err := strconv.ParseFloat(match[1], 64)
+		*dest = value
+		return err
 	}
-	fmt.Printf("Файл манифеста создан успешно: %v\n", filename)
-	if err := EditFile(filename); err != nil {
-		fmt.Printf("Ошибка редактирования файла маниыеста %v: %v\n", filename, err)
+	if vmaf {
+		return quality, parse(vmafPattern, &quality.VMAF)
+	}
+	if err := parse(psnrPattern, &quality.PSNR); err != nil {
+		return quality, err
 	}
+	return quality, parse(ssimPattern, &quality.SSIM)
+}
 
-	return nil
+// countingWriter считает записанные байты
+type countingWriter struct {
+	n int64
 }
 
-// createSegments создает сегменты видео из исходного файла с указанным разрешением
-func CreateSegments(inputFile, outputPrefix, resolution string) error {
-	cmd := exec.Command("ffmpeg", "-i", inputFile, "-c:v", "libx264", "-profile:v", "baseline", "-level", "3.0", "-s", resolution, "-start_number", "0", "-hls_time", hlsTime, "-hls_list_size", "0", "-f", "hls", "-strftime_mkdir", "1", "-hls_segment_filename", outputPrefix+"%v_%03d.ts", outputPrefix+".m3u8")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		return err
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// TrialEncode пробное кодирование фрагмента в H.264 с постоянным CRF.
+// Возвращает получившийся битрейт видео в бит/с — мера сложности фрагмента
+func TrialEncode(inputFile string, start, duration float64, crf, height int) (int, error) {
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-nostats", "-ss", strconv.FormatFloat(start, 'f', 3, 64), "-t", strconv.FormatFloat(duration, 'f', 3, 64), "-i", inputFile,
+		"-an", "-vf", fmt.Sprintf("scale=-2:%d", height), "-c:v", "libx264", "-preset", "veryfast", "-crf", strconv.Itoa(crf), "-f", "mpegts", "-")
+
+	counter := &countingWriter{}
+	var stderr strings.Builder
+	cmd.Stdout = counter
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("ffmpeg command failed: %v, %v", err, stderr.String())
 	}
-	filePath := outputPrefix + ".m3u8"
-	fmt.Printf("Файл сегмента создан успешно: %v\n", filePath)
-	if err := EditFile(filePath); err != nil {
-		fmt.Printf("Ошибка редактирования файла сегмента %v: %v\n", filePath, err)
+	if counter.n == 0 || duration <= 0 {
+		return 0, fmt.Errorf("trial encode produced no data")
 	}
 
-	return nil
+	return int(float64(counter.n*8) / duration), nil
+}
+
+// GetVideoDuration возвращает продолжительность видео в секундах
+func GetVideoDuration(filename string) (float64, error) {
+	return getVideoDurationInSeconds(filename)
+}
+
+// SegmentDuration длительность сегмента HLS в секундах
+func SegmentDuration() float64 {
+	duration, err := strconv.ParseFloat(hlsTime, 64)
+	if err != nil {
+		return 30
+	}
+	return duration
 }
 
 func getVideoDurationInSeconds(filename string) (float64, error) {
@@ -312,11 +1555,22 @@ func EditFile(filePath string) error {
 
 	for scanner.Scan() {
 		line := scanner.Text()
+		// Сегменты fMP4 и init-файл ffmpeg пишет без папки, относительно плейлиста
+		if uri, ok := strings.CutPrefix(line, `#EXT-X-MAP:URI="`); ok && !strings.Contains(uri, "/") {
+			uri = strings.TrimSuffix(uri, `"`)
+			line = fmt.Sprintf(`#EXT-X-MAP:URI="%s"`, StorageUri(filepath.ToSlash(filepath.Join(filepath.Dir(filePath), uri))))
+		} else if strings.HasSuffix(line, ".m4s") && !strings.Contains(line, "/") {
+			line = filepath.ToSlash(filepath.Join(filepath.Dir(filePath), line))
+		}
+
 		if strings.HasPrefix(line, "segments/") {
 			line = strings.ReplaceAll(line, "/", "%2F")
 		}
 
 		line = strings.Replace(line, ".ts", ".ts?alt=media", -1)
+		if strings.HasPrefix(line, "segments%2F") && !strings.Contains(line, "?alt=media") {
+			line += "?alt=media"
+		}
 
 		if _, err := writer.WriteString(line + "\n"); err != nil {
 			return err
@@ -365,3 +1619,449 @@ func CreatePoster(videoPath, outputDir string, timestamp string, hash string) (s
 
 	return outputPath, nil
 }
+
+// ClipRange фрагмент видео в секундах
+type ClipRange struct {
+	Start float64
+	End   float64
+}
+
+// Clip вырезает фрагменты видео и склеивает их в outputFile.
+// accurate — покадровая точность с перекодированием, иначе быстрый режим: резка по ключевым кадрам без перекодирования
+func Clip(inputFile, outputFile string, ranges []ClipRange, accurate bool) error {
+	if len(ranges) == 0 {
+		return fmt.Errorf("no clip ranges")
+	}
+	if accurate {
+		return clipAccurate(inputFile, outputFile, ranges)
+	}
+
+	dir, err := os.MkdirTemp("", "clip_*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var list strings.Builder
+	for n, r := range ranges {
+		part := filepath.Join(dir, fmt.Sprintf("part_%03d%s", n, filepath.Ext(outputFile)))
+		if err := runFFmpeg("-y", "-ss", formatSeconds(r.Start), "-t", formatSeconds(r.End-r.Start), "-i", inputFile,
+			"-map", "0:v", "-map", "0:a?", "-c", "copy", "-avoid_negative_ts", "make_zero", part); err != nil {
+			return err
+		}
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(part, "'", `'\''`))
+	}
+
+	listFile := filepath.Join(dir, "list.txt")
+	if err := os.WriteFile(listFile, []byte(list.String()), 0644); err != nil {
+		return err
+	}
+	return runFFmpeg("-y", "-f", "concat", "-safe", "0", "-i", listFile, "-c", "copy", "-movflags", "+faststart", outputFile)
+}
+
+// clipAccurate каждый фрагмент подается отдельным входом с точным поиском и склеивается фильтром concat
+func clipAccurate(inputFile, outputFile string, ranges []ClipRange) error {
+	streams, err := AudioStreams(inputFile)
+	if err != nil {
+		return err
+	}
+	audio := streams > 0
+
+	args := []string{"-y"}
+	var filter, concat strings.Builder
+	for n, r := range ranges {
+		args = append(args, "-ss", formatSeconds(r.Start), "-t", formatSeconds(r.End-r.Start), "-i", inputFile)
+		fmt.Fprintf(&filter, "[%d:v]setpts=PTS-STARTPTS[v%d];", n, n)
+		fmt.Fprintf(&concat, "[v%d]", n)
+		if audio {
+			fmt.Fprintf(&filter, "[%d:a:0]asetpts=PTS-STARTPTS[a%d];", n, n)
+			fmt.Fprintf(&concat, "[a%d]", n)
+		}
+	}
+	if audio {
+		fmt.Fprintf(&filter, "%sconcat=n=%d:v=1:a=1[v][a]", concat.String(), len(ranges))
+		args = append(args, "-filter_complex", filter.String(), "-map", "[v]", "-map", "[a]", "-c:a", "aac", "-b:a", "192k")
+	} else {
+		fmt.Fprintf(&filter, "%sconcat=n=%d:v=1:a=0[v]", concat.String(), len(ranges))
+		args = append(args, "-filter_complex", filter.String(), "-map", "[v]")
+	}
+	args = append(args, "-c:v", "libx264", "-preset", "medium", "-crf", "18", "-movflags", "+faststart", outputFile)
+	return runFFmpeg(args...)
+}
+
+// TitleCard титульная карточка между частями программы
+type TitleCard struct {
+	Text       string  `json:"text" firestore:"text"`
+	Duration   float64 `json:"duration" firestore:"duration"`     // по умолчанию 3 секунды
+	Background string  `json:"background" firestore:"background"` // цвет фона, по умолчанию black
+	Color      string  `json:"color" firestore:"color"`           // цвет текста, по умолчанию white
+	FontSize   int     `json:"fontSize" firestore:"fontSize"`     // по умолчанию 1/12 высоты кадра
+	FontFile   string  `json:"-" firestore:"-"`                   // шрифт, по умолчанию из fontconfig
+}
+
+// colorPattern допустимые цвета ffmpeg: имя, #RRGGBB, 0xRRGGBB[AA], с прозрачностью через @
+var colorPattern = regexp.MustCompile(`^(#|0x)?[A-Za-z0-9]+(@[0-9.]+)?$`)
+
+// ComposeItem часть программы: видео или титульная карточка
+type ComposeItem struct {
+	File string
+	Card *TitleCard
+}
+
+// ComposeOptions параметры нормализации частей программы
+type ComposeOptions struct {
+	Width              int
+	Height             int
+	FrameRate          float64
+	Transition         string  // fade — затемнение между частями, пусто — без перехода
+	TransitionDuration float64 // длительность затемнения в секундах
+}
+
+func (o ComposeOptions) withDefaults() ComposeOptions {
+	if o.Width <= 0 || o.Height <= 0 {
+		o.Width, o.Height = 1280, 720
+	}
+	if o.FrameRate <= 0 {
+		o.FrameRate = 30
+	}
+	if o.TransitionDuration <= 0 {
+		o.TransitionDuration = 0.5
+	}
+	return o
+}
+
+// Compose склеивает видео и титульные карточки в одну программу. Каждая часть приводится
+// к одному разрешению (с полями), частоте кадров и формату звука 48 кГц стерео
+func Compose(items []ComposeItem, outputFile string, opts ComposeOptions) error {
+	if len(items) == 0 {
+		return fmt.Errorf("nothing to compose")
+	}
+	opts = opts.withDefaults()
+	size := fmt.Sprintf("%dx%d", opts.Width, opts.Height)
+	rate := strconv.FormatFloat(opts.FrameRate, 'f', -1, 64)
+
+	args := []string{"-y"}
+	inputs := 0
+	addInput := func(input ...string) int {
+		args = append(args, input...)
+		inputs++
+		return inputs - 1
+	}
+
+	var filter, concat strings.Builder
+	for n, item := range items {
+		var video, audio string
+		var duration float64
+		if item.Card != nil {
+			card := *item.Card
+			if card.Duration <= 0 {
+				card.Duration = 3
+			}
+			if card.Background == "" {
+				card.Background = "black"
+			}
+			if card.Color == "" {
+				card.Color = "white"
+			}
+			if card.FontSize <= 0 {
+				card.FontSize = opts.Height / 12
+			}
+			if !colorPattern.MatchString(card.Background) || !colorPattern.MatchString(card.Color) {
+				return fmt.Errorf("invalid title card color")
+			}
+			duration = card.Duration
+
+			// Текст передается файлом, чтобы не экранировать его в графе фильтров
+			textFile, err := os.CreateTemp("", "card_*.txt")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(textFile.Name())
+			if _, err := textFile.WriteString(card.Text); err != nil {
+				textFile.Close()
+				return err
+			}
+			textFile.Close()
+
+			v := addInput("-f", "lavfi", "-t", formatSeconds(duration), "-i", fmt.Sprintf("color=c=%s:s=%s:r=%s", card.Background, size, rate))
+			a := addInput("-f", "lavfi", "-t", formatSeconds(duration), "-i", "anullsrc=r=48000:cl=stereo")
+			drawtext := fmt.Sprintf("drawtext=textfile=%s:fontcolor=%s:fontsize=%d:x=(w-text_w)/2:y=(h-text_h)/2", textFile.Name(), card.Color, card.FontSize)
+			if card.FontFile != "" {
+				drawtext += ":fontfile=" + card.FontFile
+			}
+			video = fmt.Sprintf("[%d:v]%s,format=yuv420p,setsar=1", v, drawtext)
+			audio = fmt.Sprintf("[%d:a]anull", a)
+		} else {
+			d, err := getVideoDurationInSeconds(item.File)
+			if err != nil {
+				return err
+			}
+			streams, err := AudioStreams(item.File)
+			if err != nil {
+				return err
+			}
+			duration = d
+
+			v := addInput("-i", item.File)
+			video = fmt.Sprintf("[%d:v]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=%s,format=yuv420p,setpts=PTS-STARTPTS",
+				v, opts.Width, opts.Height, opts.Width, opts.Height, rate)
+			if streams > 0 {
+				audio = fmt.Sprintf("[%d:a:0]aresample=48000,aformat=sample_fmts=fltp:channel_layouts=stereo,asetpts=PTS-STARTPTS", v)
+			} else {
+				// Тишина для частей без звука, чтобы concat получил одинаковые потоки
+				a := addInput("-f", "lavfi", "-t", formatSeconds(duration), "-i", "anullsrc=r=48000:cl=stereo")
+				audio = fmt.Sprintf("[%d:a]anull", a)
+			}
+		}
+
+		if opts.Transition == "fade" {
+			fade := math.Min(opts.TransitionDuration, duration/2)
+			out := formatSeconds(math.Max(duration-fade, 0))
+			video += fmt.Sprintf(",fade=t=in:st=0:d=%s,fade=t=out:st=%s:d=%s", formatSeconds(fade), out, formatSeconds(fade))
+			audio += fmt.Sprintf(",afade=t=in:st=0:d=%s,afade=t=out:st=%s:d=%s", formatSeconds(fade), out, formatSeconds(fade))
+		}
+		fmt.Fprintf(&filter, "%s[v%d];%s[a%d];", video, n, audio, n)
+		fmt.Fprintf(&concat, "[v%d][a%d]", n, n)
+	}
+	fmt.Fprintf(&filter, "%sconcat=n=%d:v=1:a=1[v][a]", concat.String(), len(items))
+
+	args = append(args, "-filter_complex", filter.String(), "-map", "[v]", "-map", "[a]",
+		"-c:v", "libx264", "-preset", "medium", "-crf", "18", "-c:a", "aac", "-b:a", "192k", "-movflags", "+faststart", outputFile)
+	return runFFmpeg(args...)
+}
+
+// escapeFilterValue экранирует значение параметра фильтра (путь к файлу)
+func escapeFilterValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ":", `\:`, "'", `\'`).Replace(value)
+}
+
+// BurnSubtitles впечатывает субтитры (ASS со стилем) в кадр и кодирует MP4 с указанным разрешением
+func BurnSubtitles(inputFile, subtitlesFile, outputFile, resolution string) error {
+	parts := strings.Split(resolution, "x")
+	if len(parts) != 2 {
+		return fmt.Errorf("неверный формат разрешения: %s", resolution)
+	}
+	filter := fmt.Sprintf("scale=%s:%s,subtitles=filename=%s", parts[0], parts[1], escapeFilterValue(subtitlesFile))
+
+	return runFFmpeg("-y", "-i", inputFile, "-map", "0:v:0", "-map", "0:a:0?", "-vf", filter,
+		"-c:v", "libx264", "-preset", "medium", "-crf", "20", "-c:a", "aac", "-b:a", "192k", "-movflags", "+faststart", outputFile)
+}
+
+// ReadFrames декодирует кадры с частотой fps в оттенках серого размером width x height
+// и передает их в fn вместе со временем кадра
+func ReadFrames(inputFile string, fps float64, width, height int, fn func(t float64, frame []byte) error) error {
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-nostats", "-i", inputFile, "-an",
+		"-vf", fmt.Sprintf("fps=%g,scale=%d:%d,format=gray", fps, width, height), "-f", "rawvideo", "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(stdout)
+	frame := make([]byte, width*height)
+	for n := 0; ; n++ {
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			break
+		}
+		if err := fn(float64(n)/fps, frame); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg command failed: %v, %v", err, stderr.String())
+	}
+	return nil
+}
+
+// EncodeFiltered кодирует видео в MP4 H.264 с фильтром видео filter, звук перекодируется в AAC
+func EncodeFiltered(inputFile, outputFile, filter string) error {
+	return runFFmpeg("-y", "-i", inputFile, "-filter_complex", "[0:v:0]"+filter+"[v]", "-map", "[v]", "-map", "0:a:0?",
+		"-c:v", "libx264", "-preset", "medium", "-crf", "20", "-c:a", "aac", "-b:a", "192k", "-movflags", "+faststart", outputFile)
+}
+
+// LiveRendition ступень живого потока
+type LiveRendition struct {
+	Name       string // имя плейлиста ступени
+	Resolution string
+	Bitrate    int
+}
+
+// LiveRelayCommand команда ffmpeg, которая принимает поток со входа inputArgs (RTMP или SRT в режиме сервера)
+// и без перекодирования отдает его в stdout как MPEG-TS
+func LiveRelayCommand(inputArgs []string) *exec.Cmd {
+	args := []string{"-nostats", "-loglevel", "error"}
+	args = append(args, inputArgs...)
+	args = append(args, "-map", "0:v:0", "-map", "0:a:0?", "-c", "copy", "-f", "mpegts", "pipe:1")
+	return exec.Command("ffmpeg", args...)
+}
+
+// LiveCommand команда ffmpeg, которая кодирует поток со входа inputArgs и пишет скользящий HLS:
+// master.m3u8 и плейлист на каждую ступень в outputDir. Без звука во входе ступени получают тишину,
+// чтобы у всех эфиров была одна структура.
+// Ключевые кадры выровнены по границам сегментов, чтобы плеер мог переключать ступени.
+// Ход кодирования пишется в stdout в формате -progress. При keep сегменты, вышедшие из окна, остаются на диске для архива
+func LiveCommand(inputArgs []string, audio bool, outputDir string, renditions []LiveRendition, segmentDuration float64, window int, keep bool) (*exec.Cmd, error) {
+	if len(renditions) == 0 {
+		return nil, fmt.Errorf("no renditions")
+	}
+
+	inputs := append([]string{}, inputArgs...)
+	audioInput := "0:a:0"
+	if !audio {
+		inputs = append(inputs, "-f", "lavfi", "-i", "anullsrc=r=48000:cl=stereo")
+		audioInput = "1:a:0"
+	}
+
+	split := fmt.Sprintf("[0:v:0]split=%d", len(renditions))
+	scales := []string{}
+	streamMap := []string{}
+	output := []string{}
+	for i, rendition := range renditions {
+		size := strings.Split(rendition.Resolution, "x")
+		if len(size) != 2 {
+			return nil, fmt.Errorf("неверный формат разрешения: %s", rendition.Resolution)
+		}
+		split += fmt.Sprintf("[s%d]", i)
+		scales = append(scales, fmt.Sprintf("[s%d]scale=%s:%s[v%d]", i, size[0], size[1], i))
+		streamMap = append(streamMap, fmt.Sprintf("v:%d,a:%d,name:%s", i, i, rendition.Name))
+
+		bitrate := strconv.Itoa(rendition.Bitrate)
+		output = append(output, "-map", fmt.Sprintf("[v%d]", i), "-map", audioInput,
+			fmt.Sprintf("-b:v:%d", i), bitrate,
+			fmt.Sprintf("-maxrate:v:%d", i), strconv.Itoa(rendition.Bitrate*3/2),
+			fmt.Sprintf("-bufsize:v:%d", i), strconv.Itoa(rendition.Bitrate*2))
+	}
+	segment := formatSeconds(segmentDuration)
+	// temp_file: сегмент появляется на диске только дописанным, его можно сразу отдавать
+	flags := "independent_segments+program_date_time+temp_file"
+	if !keep {
+		flags = "delete_segments+" + flags
+	}
+
+	args := []string{"-nostats", "-progress", "pipe:1"}
+	args = append(args, inputs...)
+	args = append(args, "-filter_complex", split+";"+strings.Join(scales, ";"))
+	args = append(args, output...)
+	if !audio {
+		// Тишина бесконечна, эфир заканчивается вместе с видео
+		args = append(args, "-shortest")
+	}
+	args = append(args, videoCodecs[CodecH264].args...)
+	args = append(args, "-preset", "veryfast", "-tune", "zerolatency", "-sc_threshold", "0",
+		"-force_key_frames", "expr:gte(t,n_forced*"+segment+")",
+		"-c:a", "aac", "-b:a", audioBitrate, "-ar", "48000",
+		"-f", "hls", "-hls_time", segment, "-hls_list_size", strconv.Itoa(window),
+		"-hls_flags", flags,
+		"-hls_segment_filename", filepath.Join(outputDir, "%v_%05d.ts"),
+		"-master_pl_name", "master.m3u8", "-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(outputDir, "%v.m3u8"))
+
+	return exec.Command("ffmpeg", args...), nil
+}
+
+// ConcatSegments склеивает сегменты MPEG-TS в MP4 без перекодирования.
+// Сегментов может быть тысячи, поэтому они передаются списком в файле, а не одним аргументом
+func ConcatSegments(files []string, outputFile string) error {
+	if len(files) == 0 {
+		return fmt.Errorf("no segments")
+	}
+
+	list, err := os.CreateTemp("", "concat_*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list.Name())
+
+	writer := bufio.NewWriter(list)
+	for _, file := range files {
+		// Пути в списке считаются от папки списка, поэтому пишутся абсолютными
+		path, err := filepath.Abs(file)
+		if err != nil {
+			list.Close()
+			return err
+		}
+		fmt.Fprintf(writer, "file '%s'\n", strings.ReplaceAll(path, "'", `'\''`))
+	}
+	err = writer.Flush()
+	if closeErr := list.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return runFFmpeg("-y", "-f", "concat", "-safe", "0", "-i", list.Name(), "-map", "0:v", "-map", "0:a?", "-c", "copy",
+		"-bsf:a", "aac_adtstoasc", "-movflags", "+faststart", outputFile)
+}
+
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
+
+// runFFmpeg запускает ffmpeg и возвращает stderr в тексте ошибки
+func runFFmpeg(args ...string) error {
+	cmd := exec.Command("ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg command failed: %v, %v", err, stderr.String())
+	}
+	return nil
+}
+
+// DetectScenes возвращает время смен сцен в секундах (threshold — порог фильтра scene от 0 до 1)
+func DetectScenes(videoPath string, threshold float64) ([]float64, error) {
+	cmd := exec.Command("ffmpeg", "-i", videoPath, "-an", "-filter:v", fmt.Sprintf("select='gt(scene,%.2f)',showinfo", threshold), "-f", "null", "-")
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	scenes := []float64{}
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, "pts_time:")
+		if i == -1 || !strings.Contains(line, "Parsed_showinfo") {
+			continue
+		}
+		fields := strings.Fields(line[i+len("pts_time:"):])
+		if len(fields) == 0 {
+			continue
+		}
+		if t, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			scenes = append(scenes, t)
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("ffmpeg command failed: %v", err)
+	}
+
+	return scenes, nil
+}
+
+// ExtractAudioSample вырезает фрагмент звука в WAV 16 кГц моно для распознавания
+func ExtractAudioSample(inputFile, outputFile string, start, duration float64) error {
+	cmd := exec.Command("ffmpeg", "-y", "-ss", strconv.FormatFloat(start, 'f', 3, 64), "-t", strconv.FormatFloat(duration, 'f', 3, 64), "-i", inputFile, "-vn", "-ac", "1", "-ar", "16000", "-c:a", "pcm_s16le", outputFile)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg command failed: %v, %v", err, stderr.String())
+	}
+	return nil
+}
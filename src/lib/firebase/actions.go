@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"time"
@@ -91,19 +92,45 @@ func InitClientStore(ctx context.Context) (*firestore.Client, error) {
 
 // Выгрузка видео из FireStorag
 func DownloadVideo(ctx context.Context, video string) error {
+	return DownloadFile(ctx, video, video)
+}
+
+// ReadFile читает объект Firestorage целиком
+func ReadFile(ctx context.Context, object string) ([]byte, error) {
+	client, err := InitClientStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+// StorageUrl публичная ссылка на объект Firestorage
+func StorageUrl(object string) string {
+	return "https://firebasestorage.googleapis.com/v0/b/" + bucket + "/o/" + url.PathEscape(object) + "?alt=media"
+}
+
+// DownloadFile загружает объект из Firestorage в локальный файл
+func DownloadFile(ctx context.Context, object, localPath string) error {
 	client, err := InitClientStorage(ctx)
 	if err != nil {
 		return err
 	}
 
-	rc, err := client.Bucket(bucket).Object(video).NewReader(ctx)
+	rc, err := client.Bucket(bucket).Object(object).NewReader(ctx)
 	if err != nil {
 		return err
 	}
 	defer rc.Close()
 
-	// Создание локального файла для хранения загруженного видео
-	localFile, err := os.Create(video)
+	// Создание локального файла для хранения загруженного файла
+	localFile, err := os.Create(localPath)
 	if err != nil {
 		return err
 	}
@@ -186,15 +213,18 @@ func FileExistsInFirestorage(objectName string) (bool, error) {
 
 // VideoMetadata содержит метаданные видео
 type VideoMetadata struct {
-	Title    string    `firestore:"title"`
-	Name     string    `firestore:"name"`
-	Hash     string    `firestore:"hash"`
-	Extname  string    `firestore:"extname"`
-	Storage  bool      `firestore:"storage"`
-	Segments bool      `firestore:"segments"`
-	Poster   string    `firestore:"poster"`
-	Url      string    `firestore:"url"`
-	Chapters []Chapter `firestore:"chapters"`
+	Title    string      `firestore:"title"`
+	Name     string      `firestore:"name"`
+	Hash     string      `firestore:"hash"`
+	Extname  string      `firestore:"extname"`
+	Storage  bool        `firestore:"storage"`
+	Segments bool        `firestore:"segments"`
+	Poster   string      `firestore:"poster"`
+	Url      string      `firestore:"url"`
+	Chapters []Chapter   `firestore:"chapters"`
+	Loudness interface{} `firestore:"loudness,omitempty"`
+	Parent   string      `firestore:"parent,omitempty"` // исходное видео для фрагментов
+	Ingest   interface{} `firestore:"ingest,omitempty"` // нормализация исходника
 }
 
 type Chapter struct {
@@ -204,20 +234,20 @@ type Chapter struct {
 }
 
 // SaveVideoMetadata сохраняет метаданные видео в Firestore
-func SaveVideoMetadata(ctx context.Context, metadata VideoMetadata, collection string) error {
+func SaveVideoMetadata(ctx context.Context, metadata VideoMetadata, collection string) (ref *firestore.DocumentRef, err error) {
 	client, err := InitClientStore(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	fmt.Println(metadata)
 
-	_, _, err = client.Collection(collection).Add(ctx, metadata)
+	ref, _, err = client.Collection(collection).Add(ctx, metadata)
 	if err != nil {
 		log.Printf("An error has occurred: %s", err)
-		return err
+		return nil, err
 	}
 	fmt.Printf("Записи метаданных в Firestore успешно произведене!")
-	return nil
+	return
 }
 
 type VideoCreatorMetadata struct {
@@ -229,6 +259,7 @@ type VideoCreatorMetadata struct {
 	Created time.Time `firestore:"created"`
 	Updated time.Time `firestore:"updated"`
 	Ratio   float64   `firestore:"ratio"`
+	Creator string    `firestore:"creator,omitempty"`
 }
 
 func SaveVideoCreatorMetadata(ctx context.Context, metadata VideoCreatorMetadata, collection string) (ref *firestore.DocumentRef, err error) {
@@ -262,3 +293,34 @@ func UpdateVideoMetadata(ctx context.Context, metadata map[string]interface{}, i
 	fmt.Printf("Записи метаданных в Firestore успешно обновлены!")
 	return nil
 }
+
+// GetVideoMetadata читает метаданные видео из Firestore в структуру v
+func GetVideoMetadata(ctx context.Context, id string, v interface{}) error {
+	return GetDocument(ctx, "videos", id, v)
+}
+
+// GetDocument читает документ коллекции Firestore в v
+func GetDocument(ctx context.Context, collection, id string, v interface{}) error {
+	client, err := InitClientStore(ctx)
+	if err != nil {
+		return err
+	}
+
+	doc, err := client.Collection(collection).Doc(id).Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	return doc.DataTo(v)
+}
+
+// SetDocument записывает документ коллекции Firestore целиком
+func SetDocument(ctx context.Context, collection, id string, v interface{}) error {
+	client, err := InitClientStore(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Collection(collection).Doc(id).Set(ctx, v)
+	return err
+}
@@ -0,0 +1,172 @@
+package ladder
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"m3u8.com/src/lib/ffmpeg"
+)
+
+// Options настройки анализа сложности видео
+type Options struct {
+	Samples        int     `json:"samples"`        // количество пробных фрагментов
+	SampleDuration float64 `json:"sampleDuration"` // длина фрагмента в секундах
+	CRF            int     `json:"crf"`            // CRF пробного кодирования — целевое качество
+	Height         int     `json:"height"`         // высота кадра пробного кодирования
+	MinBitrate     int     `json:"minBitrate"`     // нижняя граница битрейта ступени, бит/с
+	MaxBitrate     int     `json:"maxBitrate"`     // верхняя граница битрейта ступени, бит/с
+}
+
+func (o Options) withDefaults() Options {
+	if o.Samples <= 0 {
+		o.Samples = 5
+	}
+	if o.SampleDuration <= 0 {
+		o.SampleDuration = 4
+	}
+	if o.CRF <= 0 {
+		o.CRF = 23
+	}
+	if o.Height <= 0 {
+		o.Height = 720
+	}
+	if o.MinBitrate <= 0 {
+		o.MinBitrate = 200000
+	}
+	if o.MaxBitrate <= 0 {
+		o.MaxBitrate = 8000000
+	}
+	return o
+}
+
+// Sample результат пробного кодирования фрагмента
+type Sample struct {
+	Start   float64 `json:"start" firestore:"start"`
+	Bitrate int     `json:"bitrate" firestore:"bitrate"`
+}
+
+// Analysis результат анализа сложности видео
+type Analysis struct {
+	Samples    []Sample `json:"samples" firestore:"samples"`
+	CRF        int      `json:"crf" firestore:"crf"`
+	Width      int      `json:"width" firestore:"width"` // ширина кадра пробного кодирования, зависит от пропорций исходника
+	Height     int      `json:"height" firestore:"height"`
+	Reference  int      `json:"reference" firestore:"reference"`   // битрейт сложных сцен (90-й процентиль) в кадре Width x Height
+	Complexity float64  `json:"complexity" firestore:"complexity"` // Reference относительно типового видео
+}
+
+// Rung ступень лестницы битрейтов
+type Rung struct {
+	Resolution string `json:"resolution" firestore:"resolution"`
+	Bitrate    int    `json:"bitrate" firestore:"bitrate"`
+}
+
+// referenceBitrate битрейт типового видео 1280x720 при CRF 23
+var referenceBitrate = 2500000
+
+// referencePixels площадь кадра типового видео
+var referencePixels = 1280.0 * 720
+
+// trialWidth ширина кадра после scale=-2:height: пропорции исходника, округление до четного
+func trialWidth(input string, height int) (int, error) {
+	info, err := ffmpeg.ProbeVideo(input)
+	if err != nil {
+		return 0, err
+	}
+	// Кадры декодируются с автоповоротом
+	width, sourceHeight := info.DisplaySize()
+	if width <= 0 || sourceHeight <= 0 {
+		return 0, fmt.Errorf("unknown video size")
+	}
+	return int(math.Round(float64(height)*float64(width)/float64(sourceHeight)/2)) * 2, nil
+}
+
+// Analyze кодирует равномерно распределенные фрагменты видео с постоянным CRF
+// и оценивает сложность по получившемуся битрейту
+func Analyze(input string, duration float64, opts Options) (Analysis, error) {
+	opts = opts.withDefaults()
+	if duration <= 0 {
+		return Analysis{}, fmt.Errorf("unknown video duration")
+	}
+
+	width, err := trialWidth(input, opts.Height)
+	if err != nil {
+		return Analysis{}, err
+	}
+
+	sampleDuration := math.Min(opts.SampleDuration, duration)
+	analysis := Analysis{CRF: opts.CRF, Width: width, Height: opts.Height}
+	for i := 0; i < opts.Samples; i++ {
+		start := (float64(i) + 0.5) * duration / float64(opts.Samples)
+		start = math.Max(0, math.Min(start, duration-sampleDuration))
+		bitrate, err := ffmpeg.TrialEncode(input, start, sampleDuration, opts.CRF, opts.Height)
+		if err != nil {
+			return Analysis{}, err
+		}
+		analysis.Samples = append(analysis.Samples, Sample{Start: start, Bitrate: bitrate})
+	}
+
+	bitrates := make([]int, len(analysis.Samples))
+	for i, sample := range analysis.Samples {
+		bitrates[i] = sample.Bitrate
+	}
+	sort.Ints(bitrates)
+	analysis.Reference = bitrates[int(math.Ceil(0.9*float64(len(bitrates))))-1]
+	analysis.Complexity = float64(analysis.Reference) / float64(referenceBitrate) * math.Pow(referencePixels/float64(width*opts.Height), 0.75)
+
+	return analysis, nil
+}
+
+// Build строит лестницу битрейтов для разрешений: битрейт анализа масштабируется
+// по числу пикселей со степенью 0.75, так как на больших кадрах сжатие эффективнее
+func Build(analysis Analysis, resolutions []string, opts Options) ([]Rung, error) {
+	opts = opts.withDefaults()
+	if analysis.Reference <= 0 || analysis.Height <= 0 {
+		return nil, fmt.Errorf("empty analysis")
+	}
+	// Площадь кадра пробного кодирования; в анализах без ширины кадр считался 16:9
+	trialPixels := float64(analysis.Width) * float64(analysis.Height)
+	if analysis.Width <= 0 {
+		trialPixels = float64(analysis.Height) * float64(analysis.Height) * 16 / 9
+	}
+
+	rungs := []Rung{}
+	for _, resolution := range resolutions {
+		width, height, err := parseResolution(resolution)
+		if err != nil {
+			return nil, err
+		}
+		bitrate := float64(analysis.Reference) * math.Pow(float64(width*height)/trialPixels, 0.75)
+		bitrate = math.Max(float64(opts.MinBitrate), math.Min(bitrate, float64(opts.MaxBitrate)))
+		// Округление до 10 кбит/с
+		rungs = append(rungs, Rung{Resolution: resolution, Bitrate: int(math.Round(bitrate/10000)) * 10000})
+	}
+
+	return rungs, nil
+}
+
+// Default лестница для видео типовой сложности, когда анализ невозможен, например для живого потока
+func Default(resolutions []string, opts Options) ([]Rung, error) {
+	opts = opts.withDefaults()
+	analysis := Analysis{CRF: opts.CRF, Width: 1280, Height: 720, Reference: referenceBitrate, Complexity: 1}
+	return Build(analysis, resolutions, opts)
+}
+
+func parseResolution(resolution string) (int, int, error) {
+	parts := strings.Split(resolution, "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid resolution: %s", resolution)
+	}
+	width, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid resolution: %s", resolution)
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid resolution: %s", resolution)
+	}
+	return width, height, nil
+}
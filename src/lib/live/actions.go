@@ -0,0 +1,571 @@
+package live
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"m3u8.com/src/lib/ffmpeg"
+	"m3u8.com/src/lib/ladder"
+	"m3u8.com/src/lib/llhls"
+)
+
+// Протоколы приема
+var (
+	ProtocolRTMP = "rtmp"
+	ProtocolSRT  = "srt"
+)
+
+// Состояния потока
+var (
+	StateWaiting = "waiting" // слушаем порт, публикации еще нет
+	StateLive    = "live"
+	StateEnded   = "ended"
+	StateFailed  = "failed"
+)
+
+// keyPattern ключ потока используется в URL и путях к файлам
+var keyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,64}$`)
+
+// Options параметры живого потока
+type Options struct {
+	Protocol        string   `json:"protocol"`        // rtmp (по умолчанию) или srt
+	Resolutions     []string `json:"resolutions"`     // ступени, по умолчанию 1280x720 и 640x360
+	SegmentDuration float64  `json:"segmentDuration"` // длина сегмента в секундах, по умолчанию как у VOD
+	Window          int      `json:"window"`          // сегментов в скользящем окне, по умолчанию 6
+
+	Archive   bool    `json:"archive"`   // после эфира сохранить запись как видео
+	Title     string  `json:"title"`     // название видео из записи
+	TrimStart float64 `json:"trimStart"` // секунд до начала занятия, которые вырезаются из записи
+	TrimEnd   float64 `json:"trimEnd"`   // секунд после конца занятия
+
+	LowLatency   bool    `json:"lowLatency"`   // LL-HLS: части сегментов и блокирующая перезагрузка плейлиста
+	PartDuration float64 `json:"partDuration"` // длина части в секундах, по умолчанию 1
+}
+
+func (o Options) withDefaults() Options {
+	if o.Protocol == "" {
+		o.Protocol = ProtocolRTMP
+	}
+	if len(o.Resolutions) == 0 {
+		o.Resolutions = []string{"1280x720", "640x360"}
+	}
+	if o.LowLatency {
+		// Задержка LL-HLS — около трех частей, сегменты короткие, чтобы окно не разрасталось
+		if o.PartDuration <= 0 {
+			o.PartDuration = 1
+		}
+		if o.SegmentDuration <= 0 {
+			o.SegmentDuration = 4
+		}
+	}
+	if o.SegmentDuration <= 0 {
+		o.SegmentDuration = ffmpeg.SegmentDuration()
+	}
+	if o.Window <= 0 {
+		o.Window = 6
+	}
+	return o
+}
+
+// lowLatency параметры LL-HLS: ffmpeg режет поток на части, сегмент — PartsPerSegment частей подряд
+func (o Options) lowLatency() llhls.Config {
+	parts := int(math.Round(o.SegmentDuration / o.PartDuration))
+	if parts < 1 {
+		parts = 1
+	}
+	return llhls.Config{PartDuration: o.PartDuration, PartsPerSegment: parts, Window: o.Window}
+}
+
+// Status состояние потока по ключу
+type Status struct {
+	Key                string        `json:"key"`
+	State              string        `json:"state"`
+	Protocol           string        `json:"protocol"`
+	Playlist           string        `json:"playlist"`                     // мастер-плейлист для плеера
+	LowLatencyPlaylist string        `json:"lowLatencyPlaylist,omitempty"` // мастер-плейлист LL-HLS
+	Port               int           `json:"port"`
+	Rungs              []ladder.Rung `json:"rungs"`
+	Created            time.Time     `json:"created"`
+	Started            *time.Time    `json:"started,omitempty"` // получен первый кадр
+	Ended              *time.Time    `json:"ended,omitempty"`
+	Error              string        `json:"error,omitempty"`
+	Fps                float64       `json:"fps"`
+	Speed              float64       `json:"speed"`
+	Bitrate            string        `json:"bitrate"`
+	Duration           float64       `json:"duration"` // секунд в эфире
+	Options            Options       `json:"options"`
+	Archive            *Archive      `json:"archive,omitempty"`
+}
+
+// Состояния архивации
+var (
+	ArchiveRunning = "running"
+	ArchiveDone    = "done"
+	ArchiveFailed  = "failed"
+)
+
+// Archive видео, созданное из записи эфира
+type Archive struct {
+	State string `json:"state"`
+	Id    string `json:"id,omitempty"` // документ в videos
+	Url   string `json:"url,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Started ответ на запуск потока. Адрес публикации содержит парольную фразу SRT,
+// поэтому он отдается только тому, кто запустил поток, и не входит в Status
+type Started struct {
+	Status
+	Ingest string `json:"ingest"` // адрес для публикации из OBS или ffmpeg
+}
+
+// Active поток слушает порт или идет эфир
+func (s Status) Active() bool {
+	return s.State == StateWaiting || s.State == StateLive
+}
+
+type stream struct {
+	status  Status
+	ingest  string
+	relay   *exec.Cmd                           // прием публикации на порту
+	encode  func(audio bool) (*exec.Cmd, error) // кодирование в HLS, запускается, когда пришло начало потока
+	stopped bool                                // остановлен через Stop, а не упал
+}
+
+// Manager запускает прием потоков: на каждый ключ — свой порт и свои процессы ffmpeg.
+// Файлы потока пишутся в dir/{key}, откуда их раздает файловый сервер /stream/.
+//
+// Публикацию по SRT защищает парольная фраза из адреса Started.Ingest, которая создается при запуске потока.
+// RTMP-сервер ffmpeg принимает публикацию с любым именем потока, поэтому ключ RTMP не проверяется
+// при приеме: LIVE_STREAM_KEYS ограничивает только запуск потока через API. Порты RTMP нужно закрыть
+// от внешней сети и принимать публикацию через прокси, проверяющий ключ, либо использовать SRT
+type Manager struct {
+	dir      string
+	urlPath  string // путь, по которому dir доступен по HTTP
+	host     string // адрес сервера в ссылках для публикации
+	basePort int
+	keys     map[string]bool // разрешенные ключи, пусто — любой ключ
+
+	// OnEnd вызывается после окончания эфира с архивацией
+	OnEnd func(Status)
+	// LowLatencyPath путь, по которому подключен обработчик LL-HLS
+	LowLatencyPath string
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+// NewManager настраивается переменными окружения: LIVE_HOST, LIVE_PORT (первый порт, по умолчанию 1935)
+// и LIVE_STREAM_KEYS (разрешенные ключи через запятую)
+func NewManager(dir, urlPath string) *Manager {
+	m := &Manager{dir: dir, urlPath: urlPath, host: os.Getenv("LIVE_HOST"), basePort: 1935, keys: map[string]bool{}, streams: map[string]*stream{}}
+	if m.host == "" {
+		m.host = "localhost"
+	}
+	if port, err := strconv.Atoi(os.Getenv("LIVE_PORT")); err == nil && port > 0 {
+		m.basePort = port
+	}
+	for _, key := range strings.Split(os.Getenv("LIVE_STREAM_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			m.keys[key] = true
+		}
+	}
+	return m
+}
+
+// Start начинает слушать порт для ключа. Повторный вызов для активного потока возвращает его состояние
+func (m *Manager) Start(key string, opts Options) (Started, error) {
+	if !keyPattern.MatchString(key) {
+		return Started{}, fmt.Errorf("invalid stream key")
+	}
+	if len(m.keys) > 0 && !m.keys[key] {
+		return Started{}, fmt.Errorf("unknown stream key")
+	}
+	opts = opts.withDefaults()
+	if opts.Protocol != ProtocolRTMP && opts.Protocol != ProtocolSRT {
+		return Started{}, fmt.Errorf("unsupported protocol: %s", opts.Protocol)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.streams[key]; ok && existing.status.Active() {
+		return Started{Status: existing.status, Ingest: existing.ingest}, nil
+	}
+
+	rungs, err := ladder.Default(opts.Resolutions, ladder.Options{})
+	if err != nil {
+		return Started{}, err
+	}
+	renditions := []ffmpeg.LiveRendition{}
+	for _, rung := range rungs {
+		height := strings.Split(rung.Resolution, "x")[1]
+		renditions = append(renditions, ffmpeg.LiveRendition{Name: height + "p", Resolution: rung.Resolution, Bitrate: rung.Bitrate})
+	}
+
+	// Файлы прошлого эфира с тем же ключом удаляются
+	outputDir := filepath.Join(m.dir, key)
+	if err := os.RemoveAll(outputDir); err != nil {
+		return Started{}, err
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return Started{}, err
+	}
+
+	port := m.freePort()
+	status := Status{
+		Key:      key,
+		State:    StateWaiting,
+		Protocol: opts.Protocol,
+		Port:     port,
+		Playlist: fmt.Sprintf("%s/%s/master.m3u8", m.urlPath, key),
+		Rungs:    rungs,
+		Created:  time.Now(),
+		Options:  opts,
+	}
+	var ingest string
+	var input []string
+	if opts.Protocol == ProtocolSRT {
+		passphrase, err := newPassphrase()
+		if err != nil {
+			return Started{}, err
+		}
+		ingest = fmt.Sprintf("srt://%s:%d?streamid=%s&passphrase=%s", m.host, port, key, passphrase)
+		input = []string{"-i", fmt.Sprintf("srt://0.0.0.0:%d?mode=listener&passphrase=%s&pbkeylen=16", port, passphrase)}
+	} else {
+		ingest = fmt.Sprintf("rtmp://%s:%d/live/%s", m.host, port, key)
+		input = []string{"-listen", "1", "-i", fmt.Sprintf("rtmp://0.0.0.0:%d/live/%s", port, key)}
+	}
+
+	// В режиме LL-HLS ffmpeg пишет части, а сегменты и плейлисты LL-HLS собирает сервер.
+	// Окно частей на два сегмента больше, чтобы части не удалялись раньше, чем сегмент уйдет из плейлиста
+	hlsTime, window := opts.SegmentDuration, opts.Window
+	encodeInput := []string{"-f", "mpegts", "-i", "pipe:0"}
+	if opts.LowLatency {
+		ll := opts.lowLatency()
+		hlsTime, window = ll.PartDuration, (ll.Window+2)*ll.PartsPerSegment
+		input = append([]string{"-fflags", "nobuffer"}, input...)
+		encodeInput = append([]string{"-fflags", "nobuffer"}, encodeInput...)
+		status.LowLatencyPlaylist = fmt.Sprintf("%s/%s/master.m3u8", m.LowLatencyPath, key)
+	}
+
+	s := &stream{
+		status: status,
+		ingest: ingest,
+		relay:  ffmpeg.LiveRelayCommand(input),
+		encode: func(audio bool) (*exec.Cmd, error) {
+			return ffmpeg.LiveCommand(encodeInput, audio, outputDir, renditions, hlsTime, window, opts.Archive)
+		},
+	}
+	if err := m.run(s); err != nil {
+		return Started{}, err
+	}
+	m.streams[key] = s
+	fmt.Printf("Ожидание живого потока %v (%v) на порту %v\n", key, opts.Protocol, port)
+
+	return Started{Status: status, Ingest: ingest}, nil
+}
+
+// freePort первый порт начиная с basePort, не занятый активными потоками
+func (m *Manager) freePort() int {
+	used := map[int]bool{}
+	for _, s := range m.streams {
+		if s.status.Active() {
+			used[s.status.Port] = true
+		}
+	}
+	port := m.basePort
+	for used[port] {
+		port++
+	}
+	return port
+}
+
+// newPassphrase парольная фраза SRT (от 10 до 79 символов)
+func newPassphrase() (string, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// probeSize сколько байт от начала потока читается, чтобы узнать, есть ли в нем звук
+var probeSize = 256 * 1024
+
+// run запускает прием и следит за ним. Кодирование начинается, когда от публикующего пришло
+// начало потока, по которому видно, есть ли звук. Первый блок -progress означает начало эфира,
+// завершение приема — конец эфира (публикующий отключился или поток остановлен)
+func (m *Manager) run(s *stream) error {
+	var stderr strings.Builder
+	s.relay.Stderr = &stderr
+	relay, err := s.relay.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := s.relay.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		encodeErr := m.encode(s, relay)
+		if encodeErr != nil {
+			// Кодирование упало — принятый поток больше некому читать
+			s.relay.Process.Kill()
+		}
+		err := s.relay.Wait()
+		if encodeErr != nil {
+			err = encodeErr
+		} else if err != nil {
+			err = fmt.Errorf("%s", lastLine(stderr.String()))
+		}
+
+		m.mu.Lock()
+		now := time.Now()
+		s.status.Ended = &now
+		s.status.State = StateEnded
+		if err != nil && s.status.Started == nil && !s.stopped {
+			s.status.State = StateFailed
+			s.status.Error = err.Error()
+		}
+		fmt.Printf("Живой поток %v завершен: %v\n", s.status.Key, s.status.State)
+		if err := closePlaylists(filepath.Join(m.dir, s.status.Key)); err != nil {
+			fmt.Printf("Ошибка закрытия плейлистов %v: %v\n", s.status.Key, err)
+		}
+		status := s.status
+		m.mu.Unlock()
+
+		if status.State == StateEnded && status.Options.Archive && m.OnEnd != nil {
+			m.OnEnd(status)
+		}
+	}()
+
+	return nil
+}
+
+// encode ждет начало публикации, определяет по нему наличие звука и кодирует принятый поток в HLS.
+// Без звука в поток подмешивается тишина, чтобы плейлисты ступеней оставались одинаковыми
+func (m *Manager) encode(s *stream, relay io.Reader) error {
+	head := make([]byte, probeSize)
+	n, err := io.ReadFull(relay, head)
+	if n == 0 {
+		// Публикации не было: прием остановлен или не запустился
+		return nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	head = head[:n]
+
+	audio, err := probeAudio(head)
+	if err != nil {
+		fmt.Printf("Ошибка определения звука в потоке %v: %v\n", s.status.Key, err)
+	}
+	cmd, err := s.encode(audio)
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	cmd.Stdin = io.MultiReader(bytes.NewReader(head), relay)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !found {
+			continue
+		}
+		m.mu.Lock()
+		switch key {
+		case "fps":
+			s.status.Fps, _ = strconv.ParseFloat(value, 64)
+		case "speed":
+			s.status.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+		case "bitrate":
+			s.status.Bitrate = value
+		case "out_time_us":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				s.status.Duration = float64(us) / 1e6
+			}
+		case "progress":
+			if s.status.State == StateWaiting {
+				now := time.Now()
+				s.status.State = StateLive
+				s.status.Started = &now
+				fmt.Printf("Живой поток %v в эфире\n", s.status.Key)
+			}
+		}
+		m.mu.Unlock()
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%v: %s", err, lastLine(stderr.String()))
+	}
+	return nil
+}
+
+// probeAudio есть ли звуковая дорожка в начале потока MPEG-TS
+func probeAudio(head []byte) (bool, error) {
+	file, err := os.CreateTemp("", "live_*.ts")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(head)
+	file.Close()
+	if err != nil {
+		return false, err
+	}
+	streams, err := ffmpeg.AudioStreams(file.Name())
+	return streams > 0, err
+}
+
+// closePlaylists дописывает #EXT-X-ENDLIST в плейлисты ступеней, если ffmpeg не успел это сделать,
+// чтобы плееры перестали ждать новые сегменты
+func closePlaylists(dir string) error {
+	playlists, err := filepath.Glob(filepath.Join(dir, "*.m3u8"))
+	if err != nil {
+		return err
+	}
+	for _, playlist := range playlists {
+		if filepath.Base(playlist) == "master.m3u8" {
+			continue
+		}
+		content, err := os.ReadFile(playlist)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(content), "#EXT-X-ENDLIST") {
+			continue
+		}
+		file, err := os.OpenFile(playlist, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = file.WriteString("#EXT-X-ENDLIST\n")
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recording склеивает все сегменты старшей ступени завершенного эфира в outputFile
+func (m *Manager) Recording(key, outputFile string) error {
+	status, ok := m.Status(key)
+	if !ok {
+		return fmt.Errorf("stream %s not found", key)
+	}
+	if status.Active() {
+		return fmt.Errorf("stream %s is still live", key)
+	}
+	if !status.Options.Archive {
+		return fmt.Errorf("stream %s was not recorded", key)
+	}
+
+	// Старшая ступень — с наибольшим числом пикселей
+	top, pixels := "", 0
+	for _, rung := range status.Rungs {
+		size := strings.Split(rung.Resolution, "x")
+		width, _ := strconv.Atoi(size[0])
+		height, _ := strconv.Atoi(size[1])
+		if width*height > pixels {
+			top, pixels = size[1]+"p", width*height
+		}
+	}
+
+	// Номера сегментов дополнены нулями, поэтому сортировка по имени сохраняет порядок
+	files, err := filepath.Glob(filepath.Join(m.dir, key, top+"_*.ts"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	return ffmpeg.ConcatSegments(files, outputFile)
+}
+
+// SetArchive сохраняет состояние архивации записи
+func (m *Manager) SetArchive(key string, archive Archive) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.streams[key]; ok {
+		s.status.Archive = &archive
+	}
+}
+
+// lastLine последняя непустая строка вывода ffmpeg — обычно причина ошибки
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// Stop завершает прием; кодирование по концу входа дописывает последний сегмент и плейлисты
+func (m *Manager) Stop(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.streams[key]
+	if !ok || !s.status.Active() {
+		return fmt.Errorf("stream %s is not active", key)
+	}
+	s.stopped = true
+	return s.relay.Process.Signal(os.Interrupt)
+}
+
+// LowLatency параметры LL-HLS потока для обработчика llhls
+func (m *Manager) LowLatency(key string) (llhls.Config, bool) {
+	status, ok := m.Status(key)
+	if !ok || !status.Options.LowLatency {
+		return llhls.Config{}, false
+	}
+	return status.Options.lowLatency(), true
+}
+
+// Status состояние потока по ключу
+func (m *Manager) Status(key string) (Status, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.streams[key]
+	if !ok {
+		return Status{}, false
+	}
+	return s.status, true
+}
+
+// List состояния всех потоков, начиная с новых
+func (m *Manager) List() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := []Status{}
+	for _, s := range m.streams {
+		list = append(list, s.status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.After(list[j].Created)
+	})
+	return list
+}
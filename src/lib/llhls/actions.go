@@ -0,0 +1,333 @@
+package llhls
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config параметры LL-HLS потока: ffmpeg пишет короткие части, сервер собирает из них сегменты
+type Config struct {
+	PartDuration    float64 // целевая длина части в секундах
+	PartsPerSegment int
+	Window          int // полных сегментов в плейлисте
+}
+
+// Part часть сегмента из плейлиста ffmpeg; Index — сквозной номер части в потоке
+type Part struct {
+	Index    int
+	Duration float64
+}
+
+// ReadParts читает плейлист, который ffmpeg пишет с hls_time, равным длине части
+func ReadParts(path string) ([]Part, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	parts := []Part{}
+	sequence, duration, ended := 0, 0.0, false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			sequence, _ = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.TrimSuffix(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			duration, _ = strconv.ParseFloat(strings.Split(value, ",")[0], 64)
+		case line == "#EXT-X-ENDLIST":
+			ended = true
+		case line != "" && !strings.HasPrefix(line, "#"):
+			parts = append(parts, Part{Index: sequence + len(parts), Duration: duration})
+		}
+	}
+	return parts, ended, scanner.Err()
+}
+
+// PartUri имя файла части, совпадает с шаблоном -hls_segment_filename %v_%05d.ts
+func PartUri(name string, index int) string {
+	return fmt.Sprintf("%s_%05d.ts", name, index)
+}
+
+// SegmentUri адрес сегмента, который сервер склеивает из частей
+func SegmentUri(name string, msn int) string {
+	return fmt.Sprintf("%s_seg%05d.ts", name, msn)
+}
+
+// Render строит медиа-плейлист LL-HLS: полные сегменты, части последних трех сегментов и текущего,
+// подсказку о следующей части и параметры блокирующей перезагрузки
+func Render(name string, parts []Part, ended bool, cfg Config) string {
+	n := cfg.PartsPerSegment
+	partTarget := cfg.PartDuration
+	for _, part := range parts {
+		partTarget = math.Max(partTarget, part.Duration)
+	}
+
+	// Плейлист начинается с сегмента, все части которого еще на диске
+	first, next := 0, 0
+	if len(parts) > 0 {
+		first = (parts[0].Index + n - 1) / n
+		next = parts[len(parts)-1].Index + 1
+	}
+	complete := next / n // сегменты до complete собраны целиком
+	if ended && next%n != 0 {
+		complete++
+	}
+	if start := complete - cfg.Window; start > first {
+		first = start
+	}
+
+	byIndex := map[int]Part{}
+	for _, part := range parts {
+		byIndex[part.Index] = part
+	}
+	segmentParts := func(msn int) []Part {
+		result := []Part{}
+		for i := msn * n; i < (msn+1)*n; i++ {
+			if part, ok := byIndex[i]; ok {
+				result = append(result, part)
+			}
+		}
+		return result
+	}
+
+	var body strings.Builder
+	target := cfg.PartDuration * float64(n)
+	for msn := first; msn < complete; msn++ {
+		duration := 0.0
+		for _, part := range segmentParts(msn) {
+			// Части не старше трех сегментов от конца
+			if !ended && msn >= complete-3 {
+				writePart(&body, name, part)
+			}
+			duration += part.Duration
+		}
+		target = math.Max(target, duration)
+		fmt.Fprintf(&body, "#EXTINF:%.3f,\n%s\n", duration, SegmentUri(name, msn))
+	}
+	if !ended {
+		for _, part := range segmentParts(complete) {
+			writePart(&body, name, part)
+		}
+		fmt.Fprintf(&body, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=%q\n", PartUri(name, next))
+	} else {
+		body.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n#EXT-X-VERSION:6\n")
+	// Длительность сегмента, округленная до целого, не должна превышать TARGETDURATION
+	fmt.Fprintf(&playlist, "#EXT-X-TARGETDURATION:%d\n", int(math.Max(1, math.Round(target))))
+	fmt.Fprintf(&playlist, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+	fmt.Fprintf(&playlist, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	fmt.Fprintf(&playlist, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	playlist.WriteString(body.String())
+	return playlist.String()
+}
+
+// writePart ключевой кадр стоит в начале каждой части, поэтому все части независимы
+func writePart(body *strings.Builder, name string, part Part) {
+	fmt.Fprintf(body, "#EXT-X-PART:DURATION=%.3f,URI=%q,INDEPENDENT=YES\n", part.Duration, PartUri(name, part.Index))
+}
+
+var (
+	segmentPattern = regexp.MustCompile(`^(.+)_seg(\d+)\.ts$`)
+	partPattern    = regexp.MustCompile(`^(.+)_(\d+)\.ts$`)
+	pollInterval   = 50 * time.Millisecond
+)
+
+// Handler раздает LL-HLS потоки из dir/{key}: мастер-плейлист ffmpeg, медиа-плейлисты LL-HLS,
+// части и склеенные сегменты. config возвращает параметры потока по ключу
+func Handler(dir string, config func(key string) (Config, bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		key, file, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if !found || file == "" || strings.Contains(file, "/") || strings.Contains(file, "..") {
+			http.NotFound(w, r)
+			return
+		}
+		cfg, ok := config(key)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		stream := &stream{dir: filepath.Join(dir, key), cfg: cfg}
+
+		switch {
+		case file == "master.m3u8":
+			w.Header().Set("Cache-Control", "no-cache")
+			http.ServeFile(w, r, filepath.Join(stream.dir, file))
+		case strings.HasSuffix(file, ".m3u8"):
+			stream.servePlaylist(w, r, strings.TrimSuffix(file, ".m3u8"))
+		case segmentPattern.MatchString(file):
+			match := segmentPattern.FindStringSubmatch(file)
+			msn, _ := strconv.Atoi(match[2])
+			stream.serveSegment(w, r, match[1], msn)
+		case partPattern.MatchString(file):
+			match := partPattern.FindStringSubmatch(file)
+			index, _ := strconv.Atoi(match[2])
+			stream.servePart(w, r, match[1], index)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+type stream struct {
+	dir string
+	cfg Config
+}
+
+func (s *stream) read(name string) ([]Part, bool, error) {
+	return ReadParts(filepath.Join(s.dir, name+".m3u8"))
+}
+
+// wait перечитывает плейлист ffmpeg, пока ready не вернет true. Ждет не дольше трех длительностей сегмента
+func (s *stream) wait(r *http.Request, name string, ready func(parts []Part, ended bool) bool) ([]Part, bool, error) {
+	timeout := time.After(time.Duration(3 * s.cfg.PartDuration * float64(s.cfg.PartsPerSegment) * float64(time.Second)))
+	for {
+		parts, ended, err := s.read(name)
+		if err != nil {
+			return nil, false, err
+		}
+		if ended || ready(parts, ended) {
+			return parts, ended, nil
+		}
+		select {
+		case <-r.Context().Done():
+			return nil, false, r.Context().Err()
+		case <-timeout:
+			return nil, false, fmt.Errorf("timeout")
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// servePlaylist с _HLS_msn (и _HLS_part) ответ откладывается, пока в плейлисте не появится
+// нужный сегмент или часть — блокирующая перезагрузка
+func (s *stream) servePlaylist(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	msn, part := -1, -1
+	if value := query.Get("_HLS_msn"); value != "" {
+		var err error
+		if msn, err = strconv.Atoi(value); err != nil || msn < 0 {
+			http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("_HLS_part"); value != "" {
+		var err error
+		if part, err = strconv.Atoi(value); err != nil || part < 0 || msn < 0 {
+			http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+			return
+		}
+	}
+
+	parts, ended, err := s.read(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	n := s.cfg.PartsPerSegment
+	if msn >= 0 {
+		// Запрос больше чем на два сегмента вперед — ошибка клиента
+		next := 0
+		if len(parts) > 0 {
+			next = parts[len(parts)-1].Index + 1
+		}
+		if msn > next/n+2 {
+			http.Error(w, "_HLS_msn is too far ahead", http.StatusBadRequest)
+			return
+		}
+
+		// Без _HLS_part ждем сегмент целиком
+		want := (msn+1)*n - 1
+		if part >= 0 {
+			want = msn*n + part
+		}
+		parts, ended, err = s.wait(r, name, func(parts []Part, ended bool) bool {
+			return len(parts) > 0 && parts[len(parts)-1].Index >= want
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, Render(name, parts, ended, s.cfg))
+}
+
+// servePart часть из подсказки PRELOAD-HINT запрашивается заранее, ответ ждет, пока ffmpeg ее допишет
+func (s *stream) servePart(w http.ResponseWriter, r *http.Request, name string, index int) {
+	_, _, err := s.wait(r, name, func(parts []Part, ended bool) bool {
+		if len(parts) == 0 {
+			return false
+		}
+		last := parts[len(parts)-1].Index
+		return last >= index || index > last+1
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Cache-Control", "max-age=60")
+	http.ServeFile(w, r, filepath.Join(s.dir, PartUri(name, index)))
+}
+
+// serveSegment сегмент — подряд записанные части MPEG-TS, они склеиваются без перекодирования
+func (s *stream) serveSegment(w http.ResponseWriter, r *http.Request, name string, msn int) {
+	parts, ended, err := s.read(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	n := s.cfg.PartsPerSegment
+	available := map[int]bool{}
+	for _, part := range parts {
+		available[part.Index] = true
+	}
+	files := []string{}
+	for i := msn * n; i < (msn+1)*n; i++ {
+		if !available[i] {
+			if ended && i > msn*n && len(parts) > 0 && i > parts[len(parts)-1].Index {
+				break
+			}
+			http.NotFound(w, r)
+			return
+		}
+		files = append(files, filepath.Join(s.dir, PartUri(name, i)))
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("Cache-Control", "max-age=60")
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Ошибка чтения части %v: %v\n", path, err)
+			return
+		}
+		w.Write(data)
+	}
+}
@@ -0,0 +1,202 @@
+package llhls
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadPartsAndRender(t *testing.T) {
+	cfg := Config{PartDuration: 1, PartsPerSegment: 4, Window: 2}
+	header := "#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:4\n" +
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.000\n#EXT-X-PART-INF:PART-TARGET=1.000\n"
+
+	tests := []struct {
+		name     string
+		playlist string // плейлист, который пишет ffmpeg
+		parts    []Part
+		ended    bool
+		want     string
+	}{
+		{
+			name: "mid-segment",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:0
+#EXTINF:1.000000,
+720p_00000.ts
+#EXTINF:1.000000,
+720p_00001.ts
+#EXTINF:1.000000,
+720p_00002.ts
+#EXTINF:1.000000,
+720p_00003.ts
+#EXTINF:1.000000,
+720p_00004.ts
+#EXTINF:1.000000,
+720p_00005.ts
+`,
+			parts: []Part{{0, 1}, {1, 1}, {2, 1}, {3, 1}, {4, 1}, {5, 1}},
+			want: header + `#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PART:DURATION=1.000,URI="720p_00000.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00001.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00002.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00003.ts",INDEPENDENT=YES
+#EXTINF:4.000,
+720p_seg00000.ts
+#EXT-X-PART:DURATION=1.000,URI="720p_00004.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00005.ts",INDEPENDENT=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="720p_00006.ts"
+`,
+		},
+		{
+			name: "segment boundary",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:0
+#EXTINF:1.000000,
+720p_00000.ts
+#EXTINF:1.000000,
+720p_00001.ts
+#EXTINF:1.000000,
+720p_00002.ts
+#EXTINF:1.000000,
+720p_00003.ts
+#EXTINF:1.000000,
+720p_00004.ts
+#EXTINF:1.000000,
+720p_00005.ts
+#EXTINF:1.000000,
+720p_00006.ts
+#EXTINF:1.000000,
+720p_00007.ts
+`,
+			parts: []Part{{0, 1}, {1, 1}, {2, 1}, {3, 1}, {4, 1}, {5, 1}, {6, 1}, {7, 1}},
+			want: header + `#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PART:DURATION=1.000,URI="720p_00000.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00001.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00002.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00003.ts",INDEPENDENT=YES
+#EXTINF:4.000,
+720p_seg00000.ts
+#EXT-X-PART:DURATION=1.000,URI="720p_00004.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00005.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00006.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00007.ts",INDEPENDENT=YES
+#EXTINF:4.000,
+720p_seg00001.ts
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="720p_00008.ts"
+`,
+		},
+		{
+			name: "ended",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:2
+#EXTINF:1.000000,
+720p_00002.ts
+#EXTINF:1.000000,
+720p_00003.ts
+#EXTINF:1.000000,
+720p_00004.ts
+#EXTINF:1.000000,
+720p_00005.ts
+#EXTINF:1.000000,
+720p_00006.ts
+#EXTINF:1.000000,
+720p_00007.ts
+#EXTINF:1.000000,
+720p_00008.ts
+#EXTINF:0.520000,
+720p_00009.ts
+#EXT-X-ENDLIST
+`,
+			parts: []Part{{2, 1}, {3, 1}, {4, 1}, {5, 1}, {6, 1}, {7, 1}, {8, 1}, {9, 0.52}},
+			ended: true,
+			// Недописанный последний сегмент закрывается, частей и подсказки нет
+			want: header + `#EXT-X-MEDIA-SEQUENCE:1
+#EXTINF:4.000,
+720p_seg00001.ts
+#EXTINF:1.520,
+720p_seg00002.ts
+#EXT-X-ENDLIST
+`,
+		},
+		{
+			name: "parts deleted from window",
+			playlist: `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:6
+#EXTINF:1.000000,
+720p_00006.ts
+#EXTINF:1.000000,
+720p_00007.ts
+#EXTINF:1.000000,
+720p_00008.ts
+#EXTINF:1.000000,
+720p_00009.ts
+#EXTINF:1.000000,
+720p_00010.ts
+#EXTINF:1.000000,
+720p_00011.ts
+#EXTINF:1.000000,
+720p_00012.ts
+#EXTINF:1.000000,
+720p_00013.ts
+#EXTINF:1.000000,
+720p_00014.ts
+#EXTINF:1.000000,
+720p_00015.ts
+#EXTINF:1.000000,
+720p_00016.ts
+#EXTINF:1.000000,
+720p_00017.ts
+`,
+			parts: []Part{{6, 1}, {7, 1}, {8, 1}, {9, 1}, {10, 1}, {11, 1}, {12, 1}, {13, 1}, {14, 1}, {15, 1}, {16, 1}, {17, 1}},
+			// Части 4 и 5 удалены, поэтому сегмент 1 не собрать и плейлист начинается с сегмента 2
+			want: header + `#EXT-X-MEDIA-SEQUENCE:2
+#EXT-X-PART:DURATION=1.000,URI="720p_00008.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00009.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00010.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00011.ts",INDEPENDENT=YES
+#EXTINF:4.000,
+720p_seg00002.ts
+#EXT-X-PART:DURATION=1.000,URI="720p_00012.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00013.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00014.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00015.ts",INDEPENDENT=YES
+#EXTINF:4.000,
+720p_seg00003.ts
+#EXT-X-PART:DURATION=1.000,URI="720p_00016.ts",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1.000,URI="720p_00017.ts",INDEPENDENT=YES
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="720p_00018.ts"
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "720p.m3u8")
+			if err := os.WriteFile(path, []byte(tt.playlist), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			parts, ended, err := ReadParts(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(parts, tt.parts) || ended != tt.ended {
+				t.Fatalf("ReadParts() = %v, %v, want %v, %v", parts, ended, tt.parts, tt.ended)
+			}
+
+			if got := Render("720p", parts, ended, cfg); got != tt.want {
+				t.Errorf("Render() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package quality
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	"m3u8.com/src/lib/ffmpeg"
+)
+
+// Options настройки проверки качества рендиций
+type Options struct {
+	Samples       int     `json:"samples"`       // количество проверяемых сегментов рендиции
+	VMAFThreshold float64 `json:"vmafThreshold"` // минимально допустимый VMAF
+	PSNRThreshold float64 `json:"psnrThreshold"` // минимально допустимый PSNR, дБ (без libvmaf)
+	SSIMThreshold float64 `json:"ssimThreshold"` // минимально допустимый SSIM (без libvmaf)
+}
+
+func (o Options) withDefaults() Options {
+	if o.Samples <= 0 {
+		o.Samples = 3
+	}
+	if o.VMAFThreshold <= 0 {
+		o.VMAFThreshold = 80
+	}
+	if o.PSNRThreshold <= 0 {
+		o.PSNRThreshold = 35
+	}
+	if o.SSIMThreshold <= 0 {
+		o.SSIMThreshold = 0.95
+	}
+	return o
+}
+
+// SegmentScore оценка одного проверенного сегмента
+type SegmentScore struct {
+	Segment int            `json:"segment" firestore:"segment"`
+	Start   float64        `json:"start" firestore:"start"`
+	Quality ffmpeg.Quality `json:"quality" firestore:"quality"`
+}
+
+// Report отчет о качестве рендиции
+type Report struct {
+	Resolution string         `json:"resolution" firestore:"resolution"`
+	Codec      string         `json:"codec" firestore:"codec"`
+	Metric     string         `json:"metric" firestore:"metric"`   // vmaf или psnr/ssim
+	Quality    ffmpeg.Quality `json:"quality" firestore:"quality"` // минимум по сегментам
+	Segments   []SegmentScore `json:"segments" firestore:"segments"`
+	Flagged    bool           `json:"flagged" firestore:"flagged"` // качество ниже порога
+}
+
+// Evaluate сравнивает равномерно выбранные сегменты рендиции с исходником.
+// Итоговая оценка — худший сегмент, чтобы провалы качества не сглаживались средним
+func Evaluate(sourceFile, outputPrefix string, variant ffmpeg.Variant, opts Options) (Report, error) {
+	opts = opts.withDefaults()
+	report := Report{Resolution: variant.Resolution, Codec: variant.Codec, Metric: "psnr/ssim"}
+	if ffmpeg.HasVMAF() {
+		report.Metric = "vmaf"
+	}
+
+	segments, init, err := ffmpeg.SegmentFiles(outputPrefix, variant.Codec)
+	if err != nil {
+		return report, err
+	}
+	if len(segments) == 0 {
+		return report, fmt.Errorf("no segments found for %s", outputPrefix)
+	}
+	durations, err := ffmpeg.SegmentDurations(outputPrefix + ".m3u8")
+	if err != nil {
+		return report, err
+	}
+	if len(durations) != len(segments) {
+		return report, fmt.Errorf("playlist %s lists %d segments, found %d files", outputPrefix+".m3u8", len(durations), len(segments))
+	}
+
+	// Последний сегмент обычно короче, поэтому выбираются только полные
+	candidates := len(segments)
+	if candidates > 1 {
+		candidates--
+	}
+	samples := min(opts.Samples, candidates)
+
+	report.Quality = ffmpeg.Quality{VMAF: math.Inf(1), PSNR: math.Inf(1), SSIM: math.Inf(1)}
+	for i := 0; i < samples; i++ {
+		n := (2*i + 1) * candidates / (2 * samples)
+		segment := segments[n]
+		if init != "" {
+			// Сегменты fMP4 читаются только вместе с init-файлом
+			segment, err = joinInit(init, segments[n])
+			if err != nil {
+				return report, err
+			}
+		}
+		// Начало сегмента в исходнике — сумма длительностей предыдущих сегментов
+		start := 0.0
+		for _, duration := range durations[:n] {
+			start += duration
+		}
+		score, err := ffmpeg.CompareQuality(sourceFile, segment, start, durations[n])
+		if init != "" {
+			os.Remove(segment)
+		}
+		if err != nil {
+			return report, err
+		}
+
+		report.Segments = append(report.Segments, SegmentScore{Segment: n, Start: start, Quality: score})
+		report.Quality.VMAF = math.Min(report.Quality.VMAF, score.VMAF)
+		report.Quality.PSNR = math.Min(report.Quality.PSNR, score.PSNR)
+		report.Quality.SSIM = math.Min(report.Quality.SSIM, score.SSIM)
+	}
+
+	if report.Metric == "vmaf" {
+		report.Quality.PSNR, report.Quality.SSIM = 0, 0
+		report.Flagged = report.Quality.VMAF < opts.VMAFThreshold
+	} else {
+		report.Quality.VMAF = 0
+		report.Flagged = report.Quality.PSNR < opts.PSNRThreshold || report.Quality.SSIM < opts.SSIMThreshold
+	}
+
+	return report, nil
+}
+
+// joinInit склеивает init-файл и сегмент fMP4 во временный файл
+func joinInit(init, segment string) (string, error) {
+	header, err := os.ReadFile(init)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp("", "segment_*.mp4")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(header, data...)); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
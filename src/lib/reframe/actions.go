@@ -0,0 +1,186 @@
+package reframe
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"m3u8.com/src/lib/ffmpeg"
+)
+
+// Режимы перекадрирования
+var (
+	ModeCrop  = "crop"  // обрезка по центру
+	ModePad   = "pad"   // кадр целиком на размытом фоне
+	ModeTrack = "track" // обрезка, которая следует за движением в кадре
+)
+
+// Options параметры перекадрирования
+type Options struct {
+	Aspect string `json:"aspect"` // целевое соотношение сторон: 9:16, 1:1, 4:5
+	Mode   string `json:"mode"`   // crop, pad или track
+	Width  int    `json:"width"`  // ширина результата, по умолчанию 1080
+}
+
+// Size размер кадра результата
+func (o Options) Size() (int, int, error) {
+	a, b, err := ParseAspect(o.Aspect)
+	if err != nil {
+		return 0, 0, err
+	}
+	width := o.Width
+	if width <= 0 {
+		width = 1080
+	}
+	return even(float64(width)), even(float64(width) * float64(b) / float64(a)), nil
+}
+
+// ParseAspect разбирает соотношение сторон вида 9:16
+func ParseAspect(aspect string) (int, int, error) {
+	parts := strings.Split(aspect, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio: %q", aspect)
+	}
+	a, err := strconv.Atoi(parts[0])
+	if err != nil || a <= 0 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio: %q", aspect)
+	}
+	b, err := strconv.Atoi(parts[1])
+	if err != nil || b <= 0 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio: %q", aspect)
+	}
+	return a, b, nil
+}
+
+// even округляет вниз до четного числа — требование yuv420p
+func even(value float64) int {
+	return int(value) / 2 * 2
+}
+
+// Настройки трекера движения
+var (
+	trackFPS       = 2.0  // кадров анализа в секунду
+	trackWidth     = 160  // ширина кадра анализа
+	trackThreshold = 15   // минимальная разница яркости, которая считается движением
+	trackSmoothing = 0.3  // коэффициент экспоненциального сглаживания траектории
+	trackMinMotion = 0.01 // доля пикселей с движением, ниже которой центр не меняется
+)
+
+// Reframe создает MP4 с целевым соотношением сторон
+func Reframe(inputFile, outputFile string, opts Options) error {
+	width, height, err := opts.Size()
+	if err != nil {
+		return err
+	}
+	// Кадры декодируются уже повернутыми, поэтому обрезка считается по размеру при показе
+	info, err := ffmpeg.ProbeVideo(inputFile)
+	if err != nil {
+		return err
+	}
+	sourceWidth, sourceHeight := info.DisplaySize()
+
+	// Область обрезки с целевым соотношением сторон в координатах исходника
+	target := float64(width) / float64(height)
+	cropWidth, cropHeight := sourceWidth, sourceHeight
+	if float64(sourceWidth)/float64(sourceHeight) > target {
+		cropWidth = even(float64(sourceHeight) * target)
+	} else {
+		cropHeight = even(float64(sourceWidth) / target)
+	}
+	scale := fmt.Sprintf("scale=%d:%d,setsar=1", width, height)
+
+	var filter string
+	switch opts.Mode {
+	case ModePad:
+		filter = fmt.Sprintf("split[bg][fg];[bg]scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d,boxblur=20:5[blur];"+
+			"[fg]scale=%d:%d:force_original_aspect_ratio=decrease[front];[blur][front]overlay=(W-w)/2:(H-h)/2,setsar=1",
+			width, height, width, height, width, height)
+	case ModeTrack:
+		commands, err := trackCrop(inputFile, sourceWidth, sourceHeight, cropWidth, cropHeight)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(commands)
+		filter = fmt.Sprintf("sendcmd=f=%s,crop=%d:%d:(iw-ow)/2:(ih-oh)/2,%s", commands, cropWidth, cropHeight, scale)
+	case ModeCrop, "":
+		filter = fmt.Sprintf("crop=%d:%d:(iw-ow)/2:(ih-oh)/2,%s", cropWidth, cropHeight, scale)
+	default:
+		return fmt.Errorf("unsupported reframe mode: %s", opts.Mode)
+	}
+
+	return ffmpeg.EncodeFiltered(inputFile, outputFile, filter)
+}
+
+// trackCrop следит за центром движения в кадре и записывает траекторию обрезки
+// командами sendcmd для фильтра crop. Возвращает путь к файлу команд
+func trackCrop(inputFile string, sourceWidth, sourceHeight, cropWidth, cropHeight int) (string, error) {
+	width := trackWidth
+	height := max(even(float64(width)*float64(sourceHeight)/float64(sourceWidth)), 2)
+
+	var commands strings.Builder
+	var previous []byte
+	cx, cy := 0.5, 0.5
+	err := ffmpeg.ReadFrames(inputFile, trackFPS, width, height, func(t float64, frame []byte) error {
+		if previous != nil {
+			x, y, share := motionCenter(previous, frame, width, height)
+			if share >= trackMinMotion {
+				cx += (x - cx) * trackSmoothing
+				cy += (y - cy) * trackSmoothing
+			}
+		} else {
+			previous = make([]byte, len(frame))
+		}
+		copy(previous, frame)
+
+		left := clamp(cx*float64(sourceWidth)-float64(cropWidth)/2, 0, float64(sourceWidth-cropWidth))
+		top := clamp(cy*float64(sourceHeight)-float64(cropHeight)/2, 0, float64(sourceHeight-cropHeight))
+		fmt.Fprintf(&commands, "%.2f crop x %d, crop y %d;\n", t, even(left), even(top))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp("", "reframe_*.cmd")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(commands.String()); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// motionCenter центр масс разницы двух кадров (доли ширины и высоты) и доля пикселей с движением
+func motionCenter(previous, frame []byte, width, height int) (float64, float64, float64) {
+	sum, sumX, sumY, moving := 0.0, 0.0, 0.0, 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			diff := int(frame[i]) - int(previous[i])
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff < trackThreshold {
+				continue
+			}
+			weight := float64(diff)
+			sum += weight
+			sumX += weight * float64(x)
+			sumY += weight * float64(y)
+			moving++
+		}
+	}
+	if sum == 0 {
+		return 0.5, 0.5, 0
+	}
+	return (sumX/sum + 0.5) / float64(width), (sumY/sum + 0.5) / float64(height), float64(moving) / float64(width*height)
+}
+
+func clamp(value, low, high float64) float64 {
+	return math.Max(low, math.Min(value, high))
+}
@@ -0,0 +1,500 @@
+package search
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"m3u8.com/src/lib/subtitles"
+)
+
+// Document сегмент транскрипции в индексе; ключ — видео и время начала сегмента
+type Document struct {
+	VideoId  string  `json:"videoId"`
+	Language string  `json:"language"`
+	Source   string  `json:"source,omitempty"` // язык транскрипции, с которой сделан перевод
+	Start    float64 `json:"start"`
+	End      float64 `json:"end"`
+	Text     string  `json:"text"`
+	Context  string  `json:"context"` // текст соседних сегментов для сниппета
+	terms    []string
+}
+
+// Result найденный сегмент
+type Result struct {
+	VideoId   string  `json:"videoId"`
+	Language  string  `json:"language"`
+	Start     float64 `json:"start"`
+	Timestamp string  `json:"timestamp"`
+	Snippet   string  `json:"snippet"`
+	Score     float64 `json:"score"`
+}
+
+// Index инвертированный индекс по сегментам транскрипций, хранится в JSON файле
+type Index struct {
+	mu       sync.RWMutex
+	saveMu   sync.Mutex // сохранения идут по очереди, чтобы старый снимок не перезаписал новый
+	path     string
+	docs     map[string]*Document
+	postings map[string]map[string]int // терм -> документ -> частота
+	length   float64                   // суммарная длина документов в термах
+}
+
+// Параметры ранжирования BM25
+var (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+func docKey(videoId, language string, start float64) string {
+	return fmt.Sprintf("%s/%s@%.3f", videoId, language, start)
+}
+
+// Open загружает индекс из файла или создает пустой
+func Open(path string) (*Index, error) {
+	ix := &Index{
+		path:     path,
+		docs:     map[string]*Document{},
+		postings: map[string]map[string]int{},
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ix, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []*Document{}
+	if err := json.Unmarshal(data, &docs); err != nil {
+		return nil, fmt.Errorf("failed to decode search index: %w", err)
+	}
+	for _, doc := range docs {
+		ix.add(doc)
+	}
+	return ix, nil
+}
+
+func (ix *Index) add(doc *Document) {
+	key := docKey(doc.VideoId, doc.Language, doc.Start)
+	doc.terms = Terms(doc.Text)
+	ix.docs[key] = doc
+	ix.length += float64(len(doc.terms))
+	for _, term := range doc.terms {
+		if ix.postings[term] == nil {
+			ix.postings[term] = map[string]int{}
+		}
+		ix.postings[term][key]++
+	}
+}
+
+// remove удаляет документы видео, для которых match возвращает true
+func (ix *Index) remove(videoId string, match func(doc *Document) bool) {
+	for key, doc := range ix.docs {
+		if doc.VideoId != videoId || !match(doc) {
+			continue
+		}
+		for _, term := range doc.terms {
+			delete(ix.postings[term], key)
+			if len(ix.postings[term]) == 0 {
+				delete(ix.postings, term)
+			}
+		}
+		ix.length -= float64(len(doc.terms))
+		delete(ix.docs, key)
+	}
+}
+
+// AddTranscript индексирует транскрипцию видео, заменяя ранее проиндексированную на том же языке.
+// source — язык исходной транскрипции для перевода, пусто для самой транскрипции
+func (ix *Index) AddTranscript(videoId, language, source string, segments []subtitles.Segment) error {
+	docs := []*Document{}
+	for i, segment := range segments {
+		start, err := subtitles.ParseTimestamp(segment.Start)
+		if err != nil {
+			return err
+		}
+		end, err := subtitles.ParseTimestamp(segment.End)
+		if err != nil {
+			return err
+		}
+		context := []string{}
+		for j := max(0, i-1); j <= min(len(segments)-1, i+1); j++ {
+			context = append(context, strings.TrimSpace(segments[j].Text))
+		}
+		docs = append(docs, &Document{
+			VideoId:  videoId,
+			Language: language,
+			Source:   source,
+			Start:    start,
+			End:      end,
+			Text:     strings.TrimSpace(segment.Text),
+			Context:  strings.Join(context, " "),
+		})
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(videoId, func(doc *Document) bool { return doc.Language == language })
+	for _, doc := range docs {
+		ix.add(doc)
+	}
+	return nil
+}
+
+// Remove удаляет видео из индекса на всех языках
+func (ix *Index) Remove(videoId string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(videoId, func(doc *Document) bool { return true })
+}
+
+// RemoveLanguage удаляет транскрипцию видео на языке и сделанные с нее переводы
+func (ix *Index) RemoveLanguage(videoId, language string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.remove(videoId, func(doc *Document) bool { return doc.Language == language || doc.Source == language })
+}
+
+// Save сохраняет индекс в файл
+func (ix *Index) Save() error {
+	ix.saveMu.Lock()
+	defer ix.saveMu.Unlock()
+
+	ix.mu.RLock()
+	docs := make([]*Document, 0, len(ix.docs))
+	for _, doc := range ix.docs {
+		docs = append(docs, doc)
+	}
+	ix.mu.RUnlock()
+
+	sort.Slice(docs, func(a, b int) bool {
+		if docs[a].VideoId != docs[b].VideoId {
+			return docs[a].VideoId < docs[b].VideoId
+		}
+		return docs[a].Start < docs[b].Start
+	})
+	data, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ix.path), 0755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(ix.path), filepath.Base(ix.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), ix.path)
+}
+
+// Search ищет сегменты по запросу (BM25). Сегменты должны содержать все слова запроса
+func (ix *Index) Search(query string, limit int) []Result {
+	terms := Terms(query)
+	if len(terms) == 0 {
+		return []Result{}
+	}
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	total := float64(len(ix.docs))
+	average := 1.0
+	if total > 0 && ix.length > 0 {
+		average = ix.length / total
+	}
+
+	scores := map[string]float64{}
+	matched := map[string]int{}
+	seen := map[string]bool{}
+	for _, term := range terms {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		postings := ix.postings[term]
+		idf := math.Log(1 + (total-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		for key, tf := range postings {
+			length := float64(len(ix.docs[key].terms))
+			scores[key] += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*(1-bm25B+bm25B*length/average))
+			matched[key]++
+		}
+	}
+
+	results := []Result{}
+	for key, score := range scores {
+		if matched[key] < len(seen) {
+			continue
+		}
+		doc := ix.docs[key]
+		results = append(results, Result{
+			VideoId:   doc.VideoId,
+			Language:  doc.Language,
+			Start:     doc.Start,
+			Timestamp: subtitles.FormatTimestamp(doc.Start, "."),
+			Snippet:   snippet(doc.Context, terms),
+			Score:     score,
+		})
+	}
+	sort.Slice(results, func(a, b int) bool {
+		if results[a].Score != results[b].Score {
+			return results[a].Score > results[b].Score
+		}
+		if results[a].VideoId != results[b].VideoId {
+			return results[a].VideoId < results[b].VideoId
+		}
+		return results[a].Start < results[b].Start
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// snippetLength максимальная длина сниппета в символах
+var snippetLength = 160
+
+// snippet вырезает фрагмент текста вокруг первого совпадения и выделяет найденные слова
+func snippet(text string, terms []string) string {
+	want := map[string]bool{}
+	for _, term := range terms {
+		want[term] = true
+	}
+
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return ""
+	}
+	first := -1
+	for i, word := range words {
+		if want[Stem(normalize(word))] {
+			words[i] = "<b>" + word + "</b>"
+			if first == -1 {
+				first = i
+			}
+		}
+	}
+	if first == -1 {
+		first = 0
+	}
+
+	// расширяем окно вокруг совпадения, пока помещается
+	from, to := first, first+1
+	length := utf8.RuneCountInString(words[first])
+	for from > 0 || to < len(words) {
+		grown := false
+		if to < len(words) && length+1+utf8.RuneCountInString(words[to]) <= snippetLength {
+			length += 1 + utf8.RuneCountInString(words[to])
+			to++
+			grown = true
+		}
+		if from > 0 && length+1+utf8.RuneCountInString(words[from-1]) <= snippetLength {
+			from--
+			length += 1 + utf8.RuneCountInString(words[from])
+			grown = true
+		}
+		if !grown {
+			break
+		}
+	}
+
+	result := strings.Join(words[from:to], " ")
+	if from > 0 {
+		result = "…" + result
+	}
+	if to < len(words) {
+		result += "…"
+	}
+	return result
+}
+
+// normalize приводит слово к нижнему регистру, убирает пунктуацию и заменяет ё на е
+func normalize(word string) string {
+	word = strings.ToLower(strings.TrimFunc(word, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}))
+	return strings.ReplaceAll(word, "ё", "е")
+}
+
+// Terms разбивает текст на основы слов для индекса
+func Terms(text string) []string {
+	terms := []string{}
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		word = normalize(word)
+		if word == "" {
+			continue
+		}
+		terms = append(terms, Stem(word))
+	}
+	return terms
+}
+
+// Stem возвращает основу слова: русский стеммер для кириллицы, английский для латиницы
+func Stem(word string) string {
+	for _, r := range word {
+		if unicode.Is(unicode.Cyrillic, r) {
+			return stemRussian(word)
+		}
+	}
+	return stemEnglish(word)
+}
+
+// Окончания русского стеммера (упрощенный Snowball)
+var (
+	ruPerfectiveGerund1 = []string{"вшись", "вши", "в"} // после а или я
+	ruPerfectiveGerund2 = []string{"ившись", "ывшись", "ивши", "ывши", "ив", "ыв"}
+	ruReflexive         = []string{"ся", "сь"}
+	ruAdjective         = []string{"ими", "ыми", "его", "ого", "ему", "ому", "ее", "ие", "ые", "ое", "ей", "ий", "ый", "ой", "ем", "им", "ым", "ом", "их", "ых", "ую", "юю", "ая", "яя", "ою", "ею"}
+	ruParticiple1       = []string{"ем", "нн", "вш", "ющ", "щ"} // после а или я
+	ruParticiple2       = []string{"ивш", "ывш", "ующ"}
+	ruVerb1             = []string{"ете", "йте", "ешь", "нно", "ла", "на", "ли", "ем", "ло", "но", "ет", "ют", "ны", "ть", "й", "л", "н"} // после а или я
+	ruVerb2             = []string{"уйте", "ейте", "ила", "ыла", "ена", "ите", "или", "ыли", "ило", "ыло", "ено", "ует", "уют", "ены", "ить", "ыть", "ишь", "ей", "уй", "ил", "ыл", "им", "ым", "ен", "ят", "ит", "ыт", "ую", "ю"}
+	ruNoun              = []string{"иями", "ями", "ами", "ией", "иям", "ием", "иях", "ев", "ов", "ие", "ье", "еи", "ии", "ей", "ой", "ий", "ям", "ем", "ам", "ом", "ах", "ях", "ию", "ью", "ия", "ья", "а", "е", "и", "й", "о", "у", "ы", "ь", "ю", "я"}
+	ruSuperlative       = []string{"ейше", "ейш"}
+	ruDerivational      = []string{"ость", "ост"}
+)
+
+func isRussianVowel(r rune) bool {
+	return strings.ContainsRune("аеиоуыэюя", r)
+}
+
+// stripSuffix убирает самое длинное подходящее окончание; для preceded требуется а или я перед ним
+func stripSuffix(word []rune, suffixes []string, preceded bool) ([]rune, bool) {
+	for _, suffix := range suffixes {
+		s := []rune(suffix)
+		if len(word) < len(s) || string(word[len(word)-len(s):]) != suffix {
+			continue
+		}
+		if preceded {
+			if len(word) == len(s) {
+				continue
+			}
+			before := word[len(word)-len(s)-1]
+			if before != 'а' && before != 'я' {
+				continue
+			}
+		}
+		return word[:len(word)-len(s)], true
+	}
+	return word, false
+}
+
+// stripGroup убирает окончание из группы, где часть окончаний допустима только после а или я
+func stripGroup(word []rune, afterA, plain []string) ([]rune, bool) {
+	if result, ok := stripSuffix(word, afterA, true); ok {
+		return result, true
+	}
+	return stripSuffix(word, plain, false)
+}
+
+func stemRussian(word string) string {
+	runes := []rune(word)
+
+	// RV — часть слова после первой гласной
+	rv := len(runes)
+	for i, r := range runes {
+		if isRussianVowel(r) {
+			rv = i + 1
+			break
+		}
+	}
+	if rv >= len(runes) {
+		return word
+	}
+	prefix, region := runes[:rv], runes[rv:]
+
+	// Шаг 1
+	if result, ok := stripGroup(region, ruPerfectiveGerund1, ruPerfectiveGerund2); ok {
+		region = result
+	} else {
+		region, _ = stripSuffix(region, ruReflexive, false)
+		if result, ok := stripSuffix(region, ruAdjective, false); ok {
+			region = result
+			if result, ok := stripGroup(region, ruParticiple1, ruParticiple2); ok {
+				region = result
+			}
+		} else if result, ok := stripGroup(region, ruVerb1, ruVerb2); ok {
+			region = result
+		} else {
+			region, _ = stripSuffix(region, ruNoun, false)
+		}
+	}
+
+	// Шаг 2
+	region, _ = stripSuffix(region, []string{"и"}, false)
+
+	// Шаг 3
+	if len(region) > 4 {
+		region, _ = stripSuffix(region, ruDerivational, false)
+	}
+
+	// Шаг 4
+	if result, ok := stripSuffix(region, ruSuperlative, false); ok {
+		region = result
+	}
+	if strings.HasSuffix(string(region), "нн") {
+		region = region[:len(region)-1]
+	} else {
+		region, _ = stripSuffix(region, []string{"ь"}, false)
+	}
+
+	return string(prefix) + string(region)
+}
+
+// Окончания английского стеммера, от длинных к коротким
+var enSuffixes = []struct {
+	suffix  string
+	replace string
+}{
+	{"ational", "ate"}, {"ization", "ize"}, {"fulness", "ful"}, {"ousness", "ous"}, {"iveness", "ive"},
+	{"tional", "tion"}, {"biliti", "ble"}, {"ements", ""}, {"ement", ""}, {"ments", ""}, {"ment", ""},
+	{"ingly", ""}, {"edly", ""}, {"ies", "y"}, {"ied", "y"}, {"ing", ""}, {"ness", ""},
+	{"able", ""}, {"ible", ""}, {"ally", "al"}, {"ly", ""}, {"ed", ""}, {"es", ""}, {"s", ""},
+}
+
+func stemEnglish(word string) string {
+	if utf8.RuneCountInString(word) <= 3 || strings.HasSuffix(word, "ss") {
+		return word
+	}
+	for _, s := range enSuffixes {
+		if !strings.HasSuffix(word, s.suffix) {
+			continue
+		}
+		stem := strings.TrimSuffix(word, s.suffix) + s.replace
+		if utf8.RuneCountInString(stem) < 3 {
+			continue
+		}
+		// running -> run, stopped -> stop
+		if s.replace == "" && (s.suffix == "ing" || s.suffix == "ed") {
+			n := len(stem)
+			if n >= 2 && stem[n-1] == stem[n-2] && !strings.ContainsRune("lsz", rune(stem[n-1])) {
+				stem = stem[:n-1]
+			}
+		}
+		return strings.TrimSuffix(stem, "e")
+	}
+	return strings.TrimSuffix(word, "e")
+}
@@ -0,0 +1,680 @@
+package subtitles
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Word слово из транскрипции wscribe с таймингами
+type Word struct {
+	Start string  `json:"start"`
+	End   string  `json:"end"`
+	Text  string  `json:"text"`
+	Score float64 `json:"score"`
+}
+
+// Segment сегмент транскрипции wscribe (subtitles/output_audio.json)
+type Segment struct {
+	Text  string  `json:"text"`
+	Start string  `json:"start"`
+	End   string  `json:"end"`
+	Score float64 `json:"score"`
+	Words []Word  `json:"words"`
+}
+
+// Options настройки построения субтитров
+type Options struct {
+	MaxLineLength  int     `json:"maxLineLength"`  // максимальная длина строки в символах
+	MaxLines       int     `json:"maxLines"`       // максимальное количество строк в реплике
+	MaxCueDuration float64 `json:"maxCueDuration"` // максимальная длительность реплики в секундах
+	Balance        bool    `json:"balance"`        // выравнивать длину строк
+	MinScore       float64 `json:"minScore"`       // отбрасывать сегменты с меньшим score
+}
+
+// Cue одна реплика субтитров
+type Cue struct {
+	Start float64
+	End   float64
+	Lines []string
+	Words []Word
+}
+
+var (
+	defaultMaxLineLength  = 42
+	defaultMaxLines       = 2
+	defaultMaxCueDuration = 7.0
+)
+
+func (o Options) withDefaults() Options {
+	if o.MaxLineLength <= 0 {
+		o.MaxLineLength = defaultMaxLineLength
+	}
+	if o.MaxLines <= 0 {
+		o.MaxLines = defaultMaxLines
+	}
+	if o.MaxCueDuration <= 0 {
+		o.MaxCueDuration = defaultMaxCueDuration
+	}
+	return o
+}
+
+// ReadTranscript читает JSON файл транскрипции wscribe
+func ReadTranscript(path string) ([]Segment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transcript: %w", err)
+	}
+
+	var segments []Segment
+	if err := json.Unmarshal(data, &segments); err != nil {
+		return nil, fmt.Errorf("failed to decode transcript: %w", err)
+	}
+
+	return segments, nil
+}
+
+// WriteTranscript записывает транскрипцию в формате wscribe
+func WriteTranscript(segments []Segment, path string) error {
+	data, err := json.Marshal(segments)
+	if err != nil {
+		return fmt.Errorf("failed to encode transcript: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write transcript: %w", err)
+	}
+
+	return nil
+}
+
+// ParseTimestamp переводит время вида 00:00:03.560 (или 00:00:03,560) в секунды
+func ParseTimestamp(value string) (float64, error) {
+	value = strings.Replace(strings.TrimSpace(value), ",", ".", 1)
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp: %q", value)
+	}
+
+	total := 0.0
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid timestamp: %q", value)
+		}
+		// минуты и секунды не могут быть больше 59
+		if i > 0 && n >= 60 {
+			return 0, fmt.Errorf("invalid timestamp: %q", value)
+		}
+		total = total*60 + n
+	}
+
+	return total, nil
+}
+
+// FormatTimestamp форматирует секунды как 00:00:03.560 с указанным разделителем миллисекунд
+func FormatTimestamp(seconds float64, separator string) string {
+	if seconds < 0 {
+		seconds = 0
+	}
+	ms := int64(seconds*1000 + 0.5)
+	h := ms / 3600000
+	m := ms / 60000 % 60
+	s := ms / 1000 % 60
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", h, m, s, separator, ms%1000)
+}
+
+// BuildCues строит реплики из сегментов транскрипции
+func BuildCues(segments []Segment, opts Options) ([]Cue, error) {
+	opts = opts.withDefaults()
+
+	cues := []Cue{}
+	for _, segment := range segments {
+		if opts.MinScore > 0 && segment.Score < opts.MinScore {
+			continue
+		}
+		text := strings.Join(strings.Fields(segment.Text), " ")
+		if text == "" {
+			continue
+		}
+
+		start, err := ParseTimestamp(segment.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := ParseTimestamp(segment.End)
+		if err != nil {
+			return nil, err
+		}
+		if end <= start {
+			continue
+		}
+
+		if end-start <= opts.MaxCueDuration && fits(text, opts) {
+			cues = append(cues, Cue{Start: start, End: end, Lines: splitLines(text, opts), Words: segment.Words})
+			continue
+		}
+
+		var parts []Cue
+		if len(segment.Words) > 0 {
+			parts, err = splitByWords(segment.Words, opts)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			parts = splitByText(text, start, end, opts)
+		}
+		cues = append(cues, parts...)
+	}
+
+	return cues, nil
+}
+
+// splitByWords делит длинный сегмент на реплики по таймингам слов
+func splitByWords(words []Word, opts Options) ([]Cue, error) {
+	cues := []Cue{}
+
+	var current []Word
+	var start, end float64
+	line := ""
+
+	flush := func() {
+		if len(current) == 0 {
+			return
+		}
+		texts := make([]string, len(current))
+		for i, w := range current {
+			texts[i] = w.Text
+		}
+		cues = append(cues, Cue{Start: start, End: end, Lines: splitLines(strings.Join(texts, " "), opts), Words: current})
+		current = nil
+		line = ""
+	}
+
+	for _, word := range words {
+		text := strings.TrimSpace(word.Text)
+		if text == "" {
+			continue
+		}
+		wordStart, err := ParseTimestamp(word.Start)
+		if err != nil {
+			return nil, err
+		}
+		wordEnd, err := ParseTimestamp(word.End)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(current) > 0 && (wordEnd-start > opts.MaxCueDuration || !fits(line+" "+text, opts)) {
+			flush()
+		}
+		if len(current) == 0 {
+			start = wordStart
+			line = text
+		} else {
+			line += " " + text
+		}
+		current = append(current, word)
+		end = wordEnd
+	}
+	flush()
+
+	return cues, nil
+}
+
+// splitByText делит сегмент без таймингов слов пропорционально количеству символов
+func splitByText(text string, start, end float64, opts Options) []Cue {
+	total := float64(utf8.RuneCountInString(text))
+	pieces := []string{}
+
+	current := ""
+	for _, word := range strings.Fields(text) {
+		if current != "" && !fits(current+" "+word, opts) {
+			pieces = append(pieces, current)
+			current = ""
+		}
+		if current != "" {
+			current += " "
+		}
+		current += word
+	}
+	if current != "" {
+		pieces = append(pieces, current)
+	}
+
+	// длинные по времени куски делим дополнительно; половина куска помещается в реплику, как и весь кусок
+	for len(pieces) < int((end-start)/opts.MaxCueDuration)+1 {
+		longest := 0
+		for i, piece := range pieces {
+			if utf8.RuneCountInString(piece) > utf8.RuneCountInString(pieces[longest]) {
+				longest = i
+			}
+		}
+		words := strings.Fields(pieces[longest])
+		if len(words) < 2 {
+			break
+		}
+		half := len(words) / 2
+		pieces = append(pieces[:longest], append([]string{strings.Join(words[:half], " "), strings.Join(words[half:], " ")}, pieces[longest+1:]...)...)
+	}
+
+	cues := make([]Cue, 0, len(pieces))
+	cursor := start
+	for i, piece := range pieces {
+		share := float64(utf8.RuneCountInString(piece)) / total
+		pieceEnd := cursor + (end-start)*share
+		if i == len(pieces)-1 {
+			pieceEnd = end
+		}
+		cues = append(cues, Cue{Start: cursor, End: pieceEnd, Lines: splitLines(piece, opts)})
+		cursor = pieceEnd
+	}
+	return cues
+}
+
+// fits текст помещается в реплику: при переносе по словам получается не больше MaxLines строк.
+// Перенос по словам дает наименьшее число строк, поэтому любая часть подходящего текста тоже подходит
+func fits(text string, opts Options) bool {
+	return len(wrap(strings.Fields(text), opts.MaxLineLength)) <= opts.MaxLines
+}
+
+// wrap переносит слова на новую строку, когда текущая строка превысит length
+func wrap(words []string, length int) []string {
+	lines := []string{}
+	current := ""
+	for _, word := range words {
+		if current != "" && utf8.RuneCountInString(current)+1+utf8.RuneCountInString(word) > length {
+			lines = append(lines, current)
+			current = ""
+		}
+		if current != "" {
+			current += " "
+		}
+		current += word
+	}
+	if current != "" {
+		lines = append(lines, current)
+	}
+	return lines
+}
+
+// splitLines разбивает текст реплики на строки; реплики строятся так, чтобы текст помещался (fits)
+func splitLines(text string, opts Options) []string {
+	if utf8.RuneCountInString(text) <= opts.MaxLineLength {
+		return []string{text}
+	}
+	words := strings.Fields(text)
+
+	if opts.Balance && opts.MaxLines >= 2 {
+		// ищем разрыв с минимальной разницей длины двух строк
+		best, bestDiff := -1, 0
+		for i := 1; i < len(words); i++ {
+			left := utf8.RuneCountInString(strings.Join(words[:i], " "))
+			right := utf8.RuneCountInString(strings.Join(words[i:], " "))
+			if left > opts.MaxLineLength || right > opts.MaxLineLength {
+				continue
+			}
+			diff := left - right
+			if diff < 0 {
+				diff = -diff
+			}
+			if best == -1 || diff < bestDiff {
+				best, bestDiff = i, diff
+			}
+		}
+		if best != -1 {
+			return []string{strings.Join(words[:best], " "), strings.Join(words[best:], " ")}
+		}
+	}
+
+	return wrap(words, opts.MaxLineLength)
+}
+
+// WriteVTT записывает реплики в формате WebVTT
+func WriteVTT(cues []Cue, outputPath string) error {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString("WEBVTT\n\n"); err != nil {
+		return fmt.Errorf("failed to write to file: %w", err)
+	}
+
+	for _, cue := range cues {
+		_, err := fmt.Fprintf(file, "%s --> %s\n%s\n\n", FormatTimestamp(cue.Start, "."), FormatTimestamp(cue.End, "."), strings.Join(cue.Lines, "\n"))
+		if err != nil {
+			return fmt.Errorf("failed to write subtitle to file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// WriteSRT записывает реплики в формате SubRip
+func WriteSRT(cues []Cue, outputPath string) error {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	for n, cue := range cues {
+		_, err := fmt.Fprintf(file, "%d\n%s --> %s\n%s\n\n", n+1, FormatTimestamp(cue.Start, ","), FormatTimestamp(cue.End, ","), strings.Join(cue.Lines, "\n"))
+		if err != nil {
+			return fmt.Errorf("failed to write subtitle to file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ReadVTT читает реплики из файла WebVTT
+func ReadVTT(path string) ([]Cue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if !strings.HasPrefix(text, "WEBVTT") {
+		return nil, fmt.Errorf("invalid WebVTT file: %v", path)
+	}
+
+	cues := []Cue{}
+	for _, block := range strings.Split(text, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		for i, line := range lines {
+			if !strings.Contains(line, "-->") {
+				continue
+			}
+			timing := strings.Fields(line)
+			if len(timing) < 3 {
+				return nil, fmt.Errorf("invalid cue timing: %q", line)
+			}
+			start, err := ParseTimestamp(timing[0])
+			if err != nil {
+				return nil, err
+			}
+			end, err := ParseTimestamp(timing[2])
+			if err != nil {
+				return nil, err
+			}
+			cues = append(cues, Cue{Start: start, End: end, Lines: lines[i+1:]})
+			break
+		}
+	}
+
+	return cues, nil
+}
+
+// TimestampMap сопоставление времени WebVTT с PTS сегментов MPEG-TS (ffmpeg начинает с 1.4 с)
+var TimestampMap = "X-TIMESTAMP-MAP=MPEGTS:126000,LOCAL:00:00:00.000"
+
+// CreateSegments делит реплики на сегменты WebVTT длиной segmentDuration и создает плейлист HLS
+func CreateSegments(cues []Cue, outputPrefix string, segmentDuration, totalDuration float64) (string, error) {
+	if segmentDuration <= 0 {
+		return "", fmt.Errorf("invalid segment duration: %v", segmentDuration)
+	}
+	for _, cue := range cues {
+		if cue.End > totalDuration {
+			totalDuration = cue.End
+		}
+	}
+	if totalDuration <= 0 {
+		return "", fmt.Errorf("no cues to segment")
+	}
+
+	playlistPath := outputPrefix + ".m3u8"
+	playlist, err := os.Create(playlistPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+	defer playlist.Close()
+
+	_, err = fmt.Fprintf(playlist, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n", int(segmentDuration+0.999))
+	if err != nil {
+		return "", fmt.Errorf("failed to write to file: %w", err)
+	}
+
+	for n := 0; float64(n)*segmentDuration < totalDuration; n++ {
+		start := float64(n) * segmentDuration
+		end := start + segmentDuration
+		if end > totalDuration {
+			end = totalDuration
+		}
+
+		segmentPath := fmt.Sprintf("%s%03d.vtt", outputPrefix, n)
+		var segment strings.Builder
+		segment.WriteString("WEBVTT\n" + TimestampMap + "\n\n")
+		for _, cue := range cues {
+			if cue.End <= start || cue.Start >= end {
+				continue
+			}
+			fmt.Fprintf(&segment, "%s --> %s\n%s\n\n", FormatTimestamp(cue.Start, "."), FormatTimestamp(cue.End, "."), strings.Join(cue.Lines, "\n"))
+		}
+		if err := os.WriteFile(segmentPath, []byte(segment.String()), 0644); err != nil {
+			return "", fmt.Errorf("failed to write segment: %w", err)
+		}
+
+		if _, err := fmt.Fprintf(playlist, "#EXTINF:%.3f,\n%s\n", end-start, segmentPath); err != nil {
+			return "", fmt.Errorf("failed to write to file: %w", err)
+		}
+	}
+
+	if _, err := fmt.Fprintln(playlist, "#EXT-X-ENDLIST"); err != nil {
+		return "", fmt.Errorf("failed to write to file: %w", err)
+	}
+
+	return playlistPath, nil
+}
+
+// cueWords раскладывает слова реплики по строкам
+func cueWords(cue Cue) [][]Word {
+	lines := make([][]Word, len(cue.Lines))
+	n := 0
+	for i, line := range cue.Lines {
+		for range strings.Fields(line) {
+			if n >= len(cue.Words) {
+				return nil
+			}
+			lines[i] = append(lines[i], cue.Words[n])
+			n++
+		}
+	}
+	if n != len(cue.Words) {
+		return nil
+	}
+	return lines
+}
+
+// vttEscaper экранирует символы разметки WebVTT в тексте реплики
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// WriteKaraokeVTT записывает WebVTT с тегами времени для пословной подсветки
+func WriteKaraokeVTT(cues []Cue, outputPath string) error {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString("WEBVTT\n\n"); err != nil {
+		return fmt.Errorf("failed to write to file: %w", err)
+	}
+
+	for _, cue := range cues {
+		lines := make([]string, len(cue.Lines))
+		for i, line := range cue.Lines {
+			lines[i] = vttEscaper.Replace(line)
+		}
+		if words := cueWords(cue); words != nil {
+			lines = make([]string, len(words))
+			for i, lineWords := range words {
+				parts := make([]string, len(lineWords))
+				for j, word := range lineWords {
+					parts[j] = vttEscaper.Replace(strings.TrimSpace(word.Text))
+					// Первое слово реплики начинается вместе с ней
+					if i == 0 && j == 0 {
+						continue
+					}
+					start, err := ParseTimestamp(word.Start)
+					if err != nil {
+						return err
+					}
+					parts[j] = fmt.Sprintf("<%s>%s", FormatTimestamp(start, "."), parts[j])
+				}
+				lines[i] = strings.Join(parts, " ")
+			}
+		}
+
+		_, err := fmt.Fprintf(file, "%s --> %s\n%s\n\n", FormatTimestamp(cue.Start, "."), FormatTimestamp(cue.End, "."), strings.Join(lines, "\n"))
+		if err != nil {
+			return fmt.Errorf("failed to write subtitle to file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ASSStyle оформление субтитров ASS/SSA
+type ASSStyle struct {
+	Font            string `json:"font"`
+	Size            int    `json:"size"`
+	PrimaryColour   string `json:"primaryColour"`   // цвет подсвеченного слова, &HAABBGGRR
+	SecondaryColour string `json:"secondaryColour"` // цвет еще не произнесенного слова
+	OutlineColour   string `json:"outlineColour"`
+	Outline         int    `json:"outline"`
+	Alignment       int    `json:"alignment"` // 2 — снизу по центру, 8 — сверху по центру
+	MarginV         int    `json:"marginV"`
+	PlayResX        int    `json:"playResX"`
+	PlayResY        int    `json:"playResY"`
+}
+
+func (s ASSStyle) withDefaults() ASSStyle {
+	if s.Font == "" {
+		s.Font = "Arial"
+	}
+	if s.Size <= 0 {
+		s.Size = 48
+	}
+	if s.PrimaryColour == "" {
+		s.PrimaryColour = "&H0000FFFF"
+	}
+	if s.SecondaryColour == "" {
+		s.SecondaryColour = "&H00FFFFFF"
+	}
+	if s.OutlineColour == "" {
+		s.OutlineColour = "&H00000000"
+	}
+	if s.Outline <= 0 {
+		s.Outline = 2
+	}
+	if s.Alignment <= 0 {
+		s.Alignment = 2
+	}
+	if s.MarginV <= 0 {
+		s.MarginV = 60
+	}
+	if s.PlayResX <= 0 || s.PlayResY <= 0 {
+		s.PlayResX, s.PlayResY = 1920, 1080
+	}
+	return s
+}
+
+// formatASSTime форматирует секунды как 0:00:03.56
+func formatASSTime(seconds float64) string {
+	cs := int64(seconds*100 + 0.5)
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+}
+
+// WriteASS записывает реплики в формате ASS с караоке-тегами \kf по таймингам слов
+func WriteASS(cues []Cue, style ASSStyle, outputPath string) error {
+	style = style.withDefaults()
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	header := fmt.Sprintf(`[Script Info]
+ScriptType: v4.00+
+PlayResX: %d
+PlayResY: %d
+WrapStyle: 2
+ScaledBorderAndShadow: yes
+
+[V4+ Styles]
+Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding
+Style: Default,%s,%d,%s,%s,%s,&H80000000,0,0,0,0,100,100,0,0,1,%d,0,%d,40,40,%d,1
+
+[Events]
+Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text
+`, style.PlayResX, style.PlayResY, style.Font, style.Size, style.PrimaryColour, style.SecondaryColour, style.OutlineColour, style.Outline, style.Alignment, style.MarginV)
+	if _, err := file.WriteString(header); err != nil {
+		return fmt.Errorf("failed to write to file: %w", err)
+	}
+
+	for _, cue := range cues {
+		text, err := assText(cue)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(file, "Dialogue: 0,%s,%s,Default,,0,0,0,,%s\n", formatASSTime(cue.Start), formatASSTime(cue.End), text)
+		if err != nil {
+			return fmt.Errorf("failed to write subtitle to file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// assText текст реплики ASS; длительность \kf считается от начала слова до начала следующего
+func assText(cue Cue) (string, error) {
+	escape := strings.NewReplacer("{", "(", "}", ")", "\\", "/")
+	words := cueWords(cue)
+	if words == nil {
+		lines := make([]string, len(cue.Lines))
+		for i, line := range cue.Lines {
+			lines[i] = escape.Replace(line)
+		}
+		return strings.Join(lines, "\\N"), nil
+	}
+
+	cursor := cue.Start
+	lines := make([]string, len(words))
+	n := 0
+	for i, lineWords := range words {
+		parts := make([]string, len(lineWords))
+		for j, word := range lineWords {
+			start, err := ParseTimestamp(word.Start)
+			if err != nil {
+				return "", err
+			}
+			end, err := ParseTimestamp(word.End)
+			if err != nil {
+				return "", err
+			}
+			if n+1 < len(cue.Words) {
+				if next, err := ParseTimestamp(cue.Words[n+1].Start); err == nil && next > start {
+					end = next
+				}
+			}
+			prefix := ""
+			// Пауза перед словом
+			if gap := int((start - cursor) * 100); gap > 0 {
+				prefix = fmt.Sprintf("{\\k%d}", gap)
+			}
+			parts[j] = fmt.Sprintf("%s{\\kf%d}%s", prefix, int((end-start)*100+0.5), escape.Replace(strings.TrimSpace(word.Text)))
+			cursor = end
+			n++
+		}
+		lines[i] = strings.Join(parts, " ")
+	}
+	return strings.Join(lines, "\\N"), nil
+}
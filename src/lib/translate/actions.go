@@ -0,0 +1,138 @@
+package translate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"m3u8.com/src/lib/subtitles"
+)
+
+// Translator переводчик текстов; порядок результата совпадает с порядком texts
+type Translator interface {
+	Translate(ctx context.Context, texts []string, source, target string) ([]string, error)
+}
+
+// NewTranslator создает переводчик по адресу сервиса из TRANSLATE_URL
+func NewTranslator() (Translator, error) {
+	url := os.Getenv("TRANSLATE_URL")
+	if url == "" {
+		return nil, fmt.Errorf("TRANSLATE_URL is not set")
+	}
+	return &HTTPTranslator{Url: url, Client: http.DefaultClient}, nil
+}
+
+// Request тело запроса к сервису перевода (совместимо с LibreTranslate)
+type Request struct {
+	Q      []string `json:"q"`
+	Source string   `json:"source"`
+	Target string   `json:"target"`
+	Format string   `json:"format"`
+}
+
+// Response ответ сервиса перевода
+type Response struct {
+	TranslatedText []string `json:"translatedText"`
+	Error          string   `json:"error"`
+}
+
+// HTTPTranslator перевод через HTTP сервис: POST {Url}/translate
+type HTTPTranslator struct {
+	Url    string
+	Client *http.Client
+}
+
+func (t *HTTPTranslator) Translate(ctx context.Context, texts []string, source, target string) ([]string, error) {
+	body, err := json.Marshal(Request{Q: texts, Source: source, Target: target, Format: "text"})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(t.Url, "/")+"/translate", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := t.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var result Response
+	if err := json.NewDecoder(io.LimitReader(res.Body, 10<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode translation response: %w", err)
+	}
+	if res.StatusCode != http.StatusOK || result.Error != "" {
+		return nil, fmt.Errorf("translation service returned %v: %v", res.Status, result.Error)
+	}
+	if len(result.TranslatedText) != len(texts) {
+		return nil, fmt.Errorf("translation service returned %d texts, expected %d", len(result.TranslatedText), len(texts))
+	}
+
+	return result.TranslatedText, nil
+}
+
+// batchSize количество сегментов в одном запросе к сервису
+var batchSize = 50
+
+// TranslateTranscript переводит сегменты транскрипции, сохраняя их тайминги.
+// Тайминги слов после перевода не имеют смысла и отбрасываются
+func TranslateTranscript(ctx context.Context, translator Translator, segments []subtitles.Segment, source, target string) ([]subtitles.Segment, error) {
+	result := make([]subtitles.Segment, len(segments))
+
+	for from := 0; from < len(segments); from += batchSize {
+		to := min(from+batchSize, len(segments))
+
+		texts := make([]string, 0, to-from)
+		for _, segment := range segments[from:to] {
+			texts = append(texts, strings.TrimSpace(segment.Text))
+		}
+
+		translated, err := translator.Translate(ctx, texts, source, target)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, segment := range segments[from:to] {
+			result[from+i] = subtitles.Segment{
+				Text:  translated[i],
+				Start: segment.Start,
+				End:   segment.End,
+				Score: segment.Score,
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// StandInHandler локальная замена сервиса перевода для проверки без внешних зависимостей:
+// возвращает исходный текст с префиксом языка, например "[be] текст"
+func StandInHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/translate", func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{Error: err.Error()})
+			return
+		}
+
+		result := Response{TranslatedText: make([]string, len(req.Q))}
+		for i, text := range req.Q {
+			result.TranslatedText[i] = fmt.Sprintf("[%s] %s", req.Target, text)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+	return mux
+}
@@ -0,0 +1,99 @@
+package translate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"m3u8.com/src/lib/subtitles"
+)
+
+func TestHTTPTranslator(t *testing.T) {
+	server := httptest.NewServer(StandInHandler())
+	defer server.Close()
+
+	translator := &HTTPTranslator{Url: server.URL + "/", Client: server.Client()}
+	got, err := translator.Translate(context.Background(), []string{"привет", "мир"}, "ru", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"[en] привет", "[en] мир"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Translate() = %q, want %q", got, want)
+	}
+}
+
+func TestTranslateTranscript(t *testing.T) {
+	for _, count := range []int{0, 1, batchSize, batchSize + 1, 2*batchSize + 7} {
+		t.Run(fmt.Sprint(count), func(t *testing.T) {
+			var requests atomic.Int32
+			standIn := StandInHandler()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				standIn.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			segments := make([]subtitles.Segment, count)
+			for i := range segments {
+				segments[i] = subtitles.Segment{
+					Text:  fmt.Sprintf(" реплика %d ", i),
+					Start: subtitles.FormatTimestamp(float64(i), "."),
+					End:   subtitles.FormatTimestamp(float64(i)+0.5, "."),
+					Score: 0.9,
+					Words: []subtitles.Word{{}},
+				}
+			}
+
+			translator := &HTTPTranslator{Url: server.URL, Client: server.Client()}
+			result, err := TranslateTranscript(context.Background(), translator, segments, "ru", "be")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			batches := (count + batchSize - 1) / batchSize
+			if int(requests.Load()) != batches {
+				t.Errorf("requests = %d, want %d", requests.Load(), batches)
+			}
+			if len(result) != count {
+				t.Fatalf("len(result) = %d, want %d", len(result), count)
+			}
+			for i, segment := range result {
+				if want := fmt.Sprintf("[be] реплика %d", i); segment.Text != want {
+					t.Errorf("result[%d].Text = %q, want %q", i, segment.Text, want)
+				}
+				if segment.Start != segments[i].Start || segment.End != segments[i].End || segment.Score != segments[i].Score {
+					t.Errorf("result[%d] timing = %v-%v (%v), want %v-%v (%v)", i, segment.Start, segment.End, segment.Score,
+						segments[i].Start, segments[i].End, segments[i].Score)
+				}
+				if len(segment.Words) != 0 {
+					t.Errorf("result[%d].Words = %v, want none", i, segment.Words)
+				}
+			}
+		})
+	}
+}
+
+func TestTranslateTranscriptLengthMismatch(t *testing.T) {
+	// Сервис теряет последний текст пакета
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		json.NewEncoder(w).Encode(Response{TranslatedText: req.Q[:len(req.Q)-1]})
+	}))
+	defer server.Close()
+
+	segments := []subtitles.Segment{{Text: "один", Start: "00:00:00.000", End: "00:00:01.000"}, {Text: "два", Start: "00:00:01.000", End: "00:00:02.000"}}
+	translator := &HTTPTranslator{Url: server.URL, Client: server.Client()}
+	_, err := TranslateTranscript(context.Background(), translator, segments, "ru", "en")
+	if err == nil || !strings.Contains(err.Error(), "returned 1 texts, expected 2") {
+		t.Errorf("TranslateTranscript() error = %v, want length mismatch", err)
+	}
+}
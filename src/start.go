@@ -5,18 +5,31 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 	"m3u8.com/src/lib/ai"
+	"m3u8.com/src/lib/channel"
+	"m3u8.com/src/lib/chapters"
 	ffmpeg "m3u8.com/src/lib/ffmpeg"
 	fb "m3u8.com/src/lib/firebase"
+	"m3u8.com/src/lib/ladder"
+	"m3u8.com/src/lib/live"
+	"m3u8.com/src/lib/llhls"
 	method "m3u8.com/src/lib/methods"
+	"m3u8.com/src/lib/quality"
+	"m3u8.com/src/lib/reframe"
+	"m3u8.com/src/lib/search"
+	"m3u8.com/src/lib/subtitles"
+	"m3u8.com/src/lib/translate"
 )
 
 type Video struct {
@@ -25,6 +38,15 @@ type Video struct {
 	Resolutions []string `json:"resolutions"`
 	Id          string   `json:"id"`
 	Timestamp   string   `json:"timestamp"`
+
+	Audio       *ffmpeg.AudioOptions `json:"audio"`
+	AudioTracks []ffmpeg.AudioTrack  `json:"audioTracks"`
+	Codecs      []string             `json:"codecs"`  // дополнительные кодеки: hevc, av1
+	Ladder      *ladder.Options      `json:"ladder"`  // лестница битрейтов под контент
+	Quality     *quality.Options     `json:"quality"` // проверка качества рендиций
+	Watermark   *ffmpeg.Watermark    `json:"watermark"`
+	Creator     string               `json:"creator"`     // автор, чей водяной знак используется по умолчанию
+	Deinterlace string               `json:"deinterlace"` // bwdif (по умолчанию) или yadif
 }
 
 type Message struct {
@@ -66,66 +88,20 @@ func creatVideoSegmentsHandle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	segmentsDir := "segments"
-
 	for _, video := range m.VideoList {
-		segments := map[string]string{}
-		folderSegment := fmt.Sprintf("%v/%v", segmentsDir, video.Hash)
 		if err := fb.DownloadVideo(context.Background(), video.Name); err != nil {
 			fmt.Printf("Failed to download video file:  %v", err)
 		}
 
-		if err := os.MkdirAll(folderSegment, 0755); err != nil {
-			fmt.Printf("Ошибка при создании папки для сегментов: %v", err)
-		}
-
-		_, err := ffmpeg.CreatePoster(video.Name, folderSegment, video.Timestamp, video.Hash)
-		if err != nil {
-			http.Error(w, err.Error(), 400)
-			return
-		}
-		for _, resolution := range video.Resolutions {
-			resX := strings.Split(resolution, "x")[1]
-			segmentOutput := fmt.Sprintf("%v/%v_%v_", folderSegment, video.Hash, resX)
-			segments[resolution] = fmt.Sprintf("%v/%v_%v_.m3u8?alt=media", folderSegment, video.Hash, resX)
-			if err := ffmpeg.CreateSegments(video.Name, segmentOutput, resolution); err != nil {
-				fmt.Printf("Ошибка при создании сегментов %vp: %v\n", resX, err)
-			}
-		}
+		url, err := segmentVideo(context.Background(), video)
 		if err := method.RemoveLocalFile(video.Name); err != nil {
 			fmt.Printf("Ошибка удаления видео %v:  %v\n", video.Name, err)
 		}
-
-		manifest := fmt.Sprintf("%v/%v.m3u8", folderSegment, video.Hash)
-		if err := ffmpeg.CreateMasterM3U8(manifest, segments); err != nil {
-			fmt.Println("Ошибка при создании файла манифеста:", err)
-		}
-
-		// Загрузка сегментов обратно в Google Cloud Storage
-		files, err := method.ListFilesInDirectory(folderSegment)
 		if err != nil {
-			fmt.Printf("Error listing files: %v\n", err)
+			http.Error(w, err.Error(), 400)
 			return
 		}
 
-		if _, err := fb.UploadFilesToFireStorage(context.Background(), files, folderSegment); err != nil {
-			fmt.Println("Ошибка при загрузке в Firestorage:", err)
-		}
-
-		// Запись метаданных в Firestore
-		url := "/segments%2F" + video.Hash + "%2F" + video.Hash + ".m3u8?alt=media"
-		posterUrl := "/segments%2F" + video.Hash + "%2F" + video.Hash + ".jpg?alt=media"
-		metadata := map[string]interface{}{
-			"segments": true,
-			"url":      url,
-			"poster":   posterUrl,
-		}
-
-		err = fb.UpdateVideoMetadata(context.Background(), metadata, video.Id)
-		if err != nil {
-			fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
-		}
-
 		// Возврат успешного ответа
 		responseMessage := fmt.Sprintf("Видео, %v! Хеш: %v", video.Name, video.Hash)
 		outputData := OutputData{
@@ -149,217 +125,275 @@ func creatVideoSegmentsHandle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
-type VideoRequest struct {
-	Resolutions []string `json:"resolutions"`
-}
-
-type ProgressData = ffmpeg.ProgressData
-
-func convertVideoHandler(w http.ResponseWriter, r *http.Request) {
+// segmentVideo создает постер, рендиции HLS и мастер-манифест для локального файла video.Name,
+// загружает их в Firestorage и записывает метаданные в документ video.Id. Возвращает ссылку на манифест
+func segmentVideo(ctx context.Context, video Video) (string, error) {
+	segmentsDir := "segments"
 
-	idToken := r.URL.Query().Get("token")
-	if idToken == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
-		return
+	variants := []ffmpeg.Variant{}
+	folderSegment := fmt.Sprintf("%v/%v", segmentsDir, video.Hash)
+	if err := os.MkdirAll(folderSegment, 0755); err != nil {
+		fmt.Printf("Ошибка при создании папки для сегментов: %v", err)
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("Ошибка апгрейда соединения:", err)
-		return
+	// Все рендиции и постер делаются из нормализованного исходника
+	source := video.Name
+	normalized, ingest := normalizeSource(video.Name, video.Deinterlace, nil)
+	if normalized != source {
+		defer os.Remove(normalized)
+		video.Name = normalized
 	}
-	defer conn.Close()
 
-	claims, err := fb.IsAuthAdmin(context.Background(), idToken)
+	_, err := ffmpeg.CreatePoster(video.Name, folderSegment, video.Timestamp, video.Hash)
 	if err != nil {
-		method.ErrorMessageWS(conn, err, "Ошибка авторизации")
-		return
+		return "", err
 	}
 
-	if len(claims) == 0 {
-		method.ErrorMessageWS(conn, err, "Ошибка авторизации")
-		return
+	// Громкость измеряется один раз для всех разрешений
+	encodeOptions := audioEncodeOptions(video.Name, video.Audio)
+	encodeOptions.Watermark = resolveWatermark(ctx, video.Watermark, video.Creator)
+	if encodeOptions.Watermark != nil {
+		defer os.Remove(encodeOptions.Watermark.File)
 	}
 
-	_, message, err := conn.ReadMessage()
-	if err != nil {
-		// log.Println("Ошибка чтения сообщения из WebSocket:", err)
-		method.ErrorMessageWS(conn, err, "Ошибка чтения сообщения из WebSocket:")
+	// Субтитры, созданные ранее, остаются в манифесте
+	stream := StreamMetadata{}
+	if video.Id != "" {
+		if err := fb.GetVideoMetadata(ctx, video.Id, &stream); err != nil {
+			fmt.Printf("Ошибка чтения метаданных из Firestore: %v\n", err)
+		}
 	}
 
-	var req VideoRequest
-	err = json.Unmarshal(message, &req)
-	if err != nil {
-		method.ErrorMessageWS(conn, err, "Ошибка декодирования JSON:")
-		// log.Println("Ошибка декодирования JSON:", err)
+	// Звук выносится в отдельные аудио-рендиции, видео сегментируется без звука
+	stream.Audio = createAudioRenditions(video, folderSegment, stream.Language, encodeOptions)
+	encodeOptions.VideoOnly = len(stream.Audio) > 0
+	// Без звука в исходнике сегменты тоже без звука; если дорожки не удалось посчитать, звук считается
+	videoOnly := encodeOptions.VideoOnly
+	if count, err := ffmpeg.AudioStreams(video.Name); err == nil && count == 0 {
+		videoOnly = true
+	}
+	// Уровень HEVC и AV1 в CODECS зависит от частоты кадров рендиции
+	frameRate := 0.0
+	if info, err := ffmpeg.ProbeVideo(video.Name); err != nil {
+		fmt.Printf("Ошибка при получении частоты кадров %v: %v\n", video.Name, err)
+	} else {
+		frameRate = info.Rate()
 	}
 
-	// Create a temporary file for the uploaded video
-	tempFile, err := os.CreateTemp("", "video_*.mp4")
+	duration, err := ffmpeg.GetVideoDuration(video.Name)
 	if err != nil {
-		// log.Println("Ошибка создания временного файла:", err)
-		method.ErrorMessageWS(conn, err, "Ошибка создания временного файла:")
+		fmt.Printf("Ошибка при получении продолжительности видео: %v\n", err)
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
 
-	// Read video data from WebSocket and write to the temp file
-	for {
-		_, videoData, err := conn.ReadMessage()
+	// Битрейты ступеней по сложности видео, иначе качество по умолчанию
+	bitrates := map[string]int{}
+	var ladderMetadata *LadderMetadata
+	if video.Ladder != nil {
+		ladderMetadata, err = buildLadder(video.Name, duration, video.Resolutions, *video.Ladder)
 		if err != nil {
-			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
-				break
+			fmt.Printf("Ошибка анализа сложности видео %v: %v\n", video.Name, err)
+		} else {
+			for _, rung := range ladderMetadata.Rungs {
+				bitrates[rung.Resolution] = rung.Bitrate
 			}
-			log.Println("Ошибка чтения видео данных из WebSocket:", err)
-			return
 		}
+	}
 
-		if len(videoData) == 0 {
-			// Empty message indicates end of transmission
-			break
+	// H.264 идет первым как запасной вариант, затем дополнительные кодеки
+	outputs := []string{}
+	for _, codec := range videoCodecs(video.Codecs) {
+		codecOptions := encodeOptions
+		codecOptions.Codec = codec
+		for _, resolution := range video.Resolutions {
+			resX := strings.Split(resolution, "x")[1]
+			name := fmt.Sprintf("%v_%v_", video.Hash, resX)
+			if codec != ffmpeg.CodecH264 {
+				name = fmt.Sprintf("%v_%v_%v_", video.Hash, resX, codec)
+			}
+			segmentOutput := fmt.Sprintf("%v/%v", folderSegment, name)
+			codecOptions.Bitrate = bitrates[resolution]
+			if err := ffmpeg.CreateSegments(video.Name, segmentOutput, resolution, codecOptions); err != nil {
+				fmt.Printf("Ошибка при создании сегментов %vp %v: %v\n", resX, codec, err)
+				if codec != ffmpeg.CodecH264 {
+					continue
+				}
+			}
+			bandwidth, err := ffmpeg.SegmentsBandwidth(segmentOutput)
+			if err != nil {
+				fmt.Printf("Ошибка при расчете битрейта %vp %v: %v\n", resX, codec, err)
+			}
+			codecs, err := ffmpeg.CodecsFor(codec, resolution, frameRate, bandwidth)
+			if err != nil {
+				fmt.Printf("Ошибка кодека %v: %v\n", codec, err)
+				continue
+			}
+			variants = append(variants, ffmpeg.Variant{
+				Resolution: resolution,
+				Uri:        fmt.Sprintf("%v/%v.m3u8?alt=media", folderSegment, name),
+				Bandwidth:  bandwidth,
+				Codec:      codec,
+				Codecs:     codecs,
+				VideoOnly:  videoOnly,
+			})
+			outputs = append(outputs, segmentOutput)
 		}
+	}
 
-		_, err = tempFile.Write(videoData)
-		if err != nil {
-			log.Println("Ошибка записи видео данных во временный файл:", err)
-			return
-		}
+	// Проверка качества рендиций на выборочных сегментах, пока исходник на диске
+	reports := []quality.Report{}
+	if video.Quality != nil {
+		reports = checkQuality(video.Name, variants, outputs, *video.Quality)
 	}
 
-	// Close temp file to ensure all data is flushed to disk
-	err = tempFile.Close()
-	if err != nil {
-		log.Println("Ошибка закрытия временного файла:", err)
-		return
+	manifest := fmt.Sprintf("%v/%v.m3u8", folderSegment, video.Hash)
+	stream.Variants = variants
+	if err := ffmpeg.CreateMasterM3U8(manifest, stream.master()); err != nil {
+		fmt.Println("Ошибка при создании файла манифеста:", err)
 	}
 
-	// Generate hash of the uploaded video
-	hash, err := method.GenerateFileHash(tempFile.Name())
+	// Загрузка сегментов обратно в Google Cloud Storage
+	files, err := method.ListFilesInDirectory(folderSegment)
 	if err != nil {
-		log.Println("ошибка при генерации хеша файла:", err)
-		return
+		fmt.Printf("Error listing files: %v\n", err)
+		return "", err
 	}
-	outputDirName := "output"
-	storageDirName := "videos"
 
-	// Check if a file with the same hash already exists
-	for n, resolution := range req.Resolutions {
+	if _, err := fb.UploadFilesToFireStorage(ctx, files, folderSegment); err != nil {
+		fmt.Println("Ошибка при загрузке в Firestorage:", err)
+	}
 
-		parts := strings.Split(resolution, "x")
-		if len(parts) != 2 {
-			return
-		}
+	// Запись метаданных в Firestore
+	url := "/segments%2F" + video.Hash + "%2F" + video.Hash + ".m3u8?alt=media"
+	posterUrl := "/segments%2F" + video.Hash + "%2F" + video.Hash + ".jpg?alt=media"
+	metadata := map[string]interface{}{
+		"segments": true,
+		"url":      url,
+		"poster":   posterUrl,
+		"variants": variants,
+		"duration": duration,
+		"audio":    stream.Audio,
+		"source":   source,
+	}
+	if ingest != nil {
+		metadata["ingest"] = ingest
+	}
+	if encodeOptions.Loudness != nil {
+		metadata["loudness"] = encodeOptions.Loudness
+	}
+	if ladderMetadata != nil {
+		metadata["ladder"] = ladderMetadata
+	}
+	if video.Quality != nil {
+		metadata["quality"] = reports
+		metadata["qualityFlagged"] = qualityFlagged(reports)
+	}
 
-		width := parts[0]
-		height := parts[1]
+	err = fb.UpdateVideoMetadata(ctx, metadata, video.Id)
+	if err != nil {
+		fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
+	}
 
-		outputFileName := fmt.Sprintf("%s/%s_%s_%s.mp4", outputDirName, hash, width, height)
-		objectName := fmt.Sprintf("%s/%s_%s_%s.mp4", storageDirName, hash, width, height)
-		outputFilesName := []string{outputFileName}
-		if err := os.MkdirAll(outputDirName, 0755); err != nil {
-			log.Fatal("Ошибка при создании папки для сегментов:", err)
-		}
+	return url, nil
+}
 
-		// проверяем загружен ли файл в firestorage
-		exists, err := fb.FileExistsInFirestorage(objectName)
-		if err != nil {
-			fmt.Printf("Error checking file existence: %v\n", err)
-		} else if exists {
-			fmt.Printf("Файл уже загружен в Firestorage: %s\n", outputFileName)
-			result := method.ErrorSW{
-				Success: false,
-				Error:   "File was load",
-				Message: fmt.Sprintf("Файл уже загружен в Firestorage: %s", outputFileName),
-			}
+// normalizeSource поворачивает, убирает чересстрочность, переводит HDR в SDR и VFR в CFR.
+// Возвращает путь к файлу для обработки: нормализованный или исходный, если править нечего
+func normalizeSource(input, deinterlacer string, progress *ffmpeg.Tracker) (string, *ffmpeg.Normalization) {
+	output := strings.TrimSuffix(input, filepath.Ext(input)) + "_normalized.mp4"
+	normalization, err := ffmpeg.NormalizeVideo(input, output, deinterlacer, progress)
+	if err != nil {
+		fmt.Printf("Ошибка нормализации %v: %v\n", input, err)
+		os.Remove(output)
+		return input, nil
+	}
+	if !normalization.Applied() {
+		return input, &normalization
+	}
+	return output, &normalization
+}
 
-			bytes, err := json.Marshal(result)
-			if err != nil {
-				log.Printf("Error sending progress message: %v", err)
-				break
-			}
+// ClipRange фрагмент для вырезания, время в формате 00:01:02.500
+type ClipRange struct {
+	In  string `json:"in" firestore:"in"`
+	Out string `json:"out" firestore:"out"`
+}
 
-			conn.WriteMessage(websocket.TextMessage, bytes)
-			return
-		} else {
-			fmt.Printf("File %v does not exist in the bucket.\n", objectName)
-		}
+// ClipRequest запрос на вырезание фрагментов видео
+type ClipRequest struct {
+	Id          string      `json:"id"` // исходное видео
+	Ranges      []ClipRange `json:"ranges"`
+	Accurate    bool        `json:"accurate"` // покадровая точность вместо резки по ключевым кадрам
+	Title       string      `json:"title"`
+	Resolutions []string    `json:"resolutions"` // по умолчанию разрешения исходного видео
+	Timestamp   string      `json:"timestamp"`   // кадр для постера
+}
 
-		// проверяем загружен ли файл локально
-		log.Println(outputFileName)
-		if _, err := os.Stat(outputFileName); err == nil {
-			// File already exists
-			log.Println("Файл уже загружен на сервер:", outputFileName)
-			result := ProgressData{
-				Success:          false,
-				Error:            fmt.Sprintf("Файл уже загружен на сервер: %s", outputFileName),
-				TotalResolutions: n,
-				Size:             parts,
-			}
+// ParentVideo метаданные исходного видео, нужные для вырезания
+type ParentVideo struct {
+	Title    string           `firestore:"title"`
+	Name     string           `firestore:"name"`
+	Extname  string           `firestore:"extname"`
+	Source   string           `firestore:"source"`
+	Variants []ffmpeg.Variant `firestore:"variants"`
+}
 
-			bytes, err := json.Marshal(result)
-			if err != nil {
-				log.Printf("Error sending progress message: %v", err)
-				break
-			}
-			conn.WriteMessage(websocket.TextMessage, bytes)
+// sourcePath путь к исходному файлу в Firestorage
+func (p ParentVideo) sourcePath() string {
+	if p.Source != "" {
+		return p.Source
+	}
+	return fmt.Sprintf("videos/%v.%v", p.Name, p.Extname)
+}
 
-			// значит не будем конвертировать и грузим в Firestorage
-			if _, err := fb.UploadFilesToFireStorage(context.Background(), outputFilesName, storageDirName); err != nil {
-				fmt.Printf("Failed to upload file: %v\n", err)
-			} else {
-				fmt.Println("Файл загружен в Firestorage")
-			}
-			return
+// resolutions разрешения H.264 рендиций без повторов
+func (p ParentVideo) resolutions() []string {
+	result := []string{}
+	for _, variant := range p.Variants {
+		if (variant.Codec == "" || variant.Codec == ffmpeg.CodecH264) && !slices.Contains(result, variant.Resolution) {
+			result = append(result, variant.Resolution)
 		}
+	}
+	return result
+}
 
-		// Convert the video
-		err = ffmpeg.ConvertVideo(tempFile.Name(), req.Resolutions, conn)
+// clipRanges разбирает и проверяет фрагменты относительно длительности исходника
+func clipRanges(ranges []ClipRange, duration float64) ([]ffmpeg.ClipRange, error) {
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no ranges")
+	}
+	result := []ffmpeg.ClipRange{}
+	for n, r := range ranges {
+		start, err := subtitles.ParseTimestamp(r.In)
 		if err != nil {
-			log.Println("Ошибка конвертации видео:", err)
-			return
-		}
-
-		// Создание метаданных
-		metadata := fb.VideoMetadata{
-			Title:    "",
-			Name:     fmt.Sprintf("%s_%s_%s", hash, width, height),
-			Hash:     hash,
-			Extname:  "mp4",
-			Storage:  false,
-			Segments: false,
-			Poster:   "",
-			Url:      "",
+			return nil, fmt.Errorf("range %d: %v", n+1, err)
 		}
-
-		_, err = fb.UploadFilesToFireStorage(context.Background(), outputFilesName, storageDirName)
+		end, err := subtitles.ParseTimestamp(r.Out)
 		if err != nil {
-			fmt.Printf("Failed to upload file: %v\n", err)
-		} else {
-			metadata.Storage = true
-			fmt.Println("Файл загружен в Firestorage")
+			return nil, fmt.Errorf("range %d: %v", n+1, err)
 		}
-
-		// Запись метаданных в Firestore
-		err = fb.SaveVideoMetadata(context.Background(), metadata, "videos")
-		if err != nil {
-			fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
+		if end <= start {
+			return nil, fmt.Errorf("range %d: out %v is not after in %v", n+1, r.Out, r.In)
 		}
+		if duration > 0 && start >= duration {
+			return nil, fmt.Errorf("range %d: in %v is beyond video duration", n+1, r.In)
+		}
+		if duration > 0 {
+			end = math.Min(end, duration)
+		}
+		result = append(result, ffmpeg.ClipRange{Start: start, End: end})
 	}
-
+	return result, nil
 }
 
-type PosterData struct {
-	Video     string `json:"video"`
-	Timestamp string `json:"timestamp"`
+// ClipResult новое видео, созданное из фрагментов
+type ClipResult struct {
+	Success bool   `json:"success"`
+	Id      string `json:"id"`
+	Url     string `json:"url"`
 }
 
-func creatPosterHandle(w http.ResponseWriter, r *http.Request) {
+// clipHandle вырезает фрагменты исходного видео в новое видео со своими рендициями и постером
+func clipHandle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
@@ -375,50 +409,1933 @@ func creatPosterHandle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var m PosterData
-
+	var req ClipRequest
 	if r.Body == nil {
 		http.Error(w, "Please send a request body", 400)
 		return
 	}
-	err := json.NewDecoder(r.Body).Decode(&m)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if req.Id == "" {
+		http.Error(w, "Missing id", 400)
+		return
+	}
+
+	ctx := context.Background()
+	parent := ParentVideo{}
+	if err := fb.GetVideoMetadata(ctx, req.Id, &parent); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if len(req.Resolutions) == 0 {
+		req.Resolutions = parent.resolutions()
+	}
+	if len(req.Resolutions) == 0 {
+		http.Error(w, "Missing resolutions", 400)
+		return
+	}
+
+	source, err := downloadSource(ctx, parent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(source)
+
+	duration, err := ffmpeg.GetVideoDuration(source)
+	if err != nil {
+		fmt.Printf("Ошибка при получении продолжительности видео: %v\n", err)
+	}
+	ranges, err := clipRanges(req.Ranges, duration)
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	fmt.Println(m)
 
-	if err := fb.DownloadVideo(context.Background(), m.Video); err != nil {
-		fmt.Printf("Failed to download video file:  %v", err)
+	clipsDir := "clips"
+	tempFile, err := derivedTempFile(clipsDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tempFile)
+
+	if err := ffmpeg.Clip(source, tempFile, ranges, req.Accurate); err != nil {
+		fmt.Println("Ошибка при вырезании фрагмента:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	title := req.Title
+	if title == "" {
+		title = parent.Title
+	}
+	derived := DerivedVideo{
+		File:        tempFile,
+		Dir:         clipsDir,
+		Title:       title,
+		Parent:      req.Id,
+		Resolutions: req.Resolutions,
+		Timestamp:   req.Timestamp,
+		Metadata:    map[string]interface{}{"clip": req.Ranges},
+	}
+	id, url, err := publishDerivedVideo(ctx, derived)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(ClipResult{Success: true, Id: id, Url: url})
+}
+
+// ComposeItem часть программы: существующее видео или титульная карточка
+type ComposeItem struct {
+	Id   string            `json:"id" firestore:"id"`
+	Card *ffmpeg.TitleCard `json:"card" firestore:"card"`
+}
+
+// ComposeRequest запрос на склейку нескольких видео в одну программу
+type ComposeRequest struct {
+	Items              []ComposeItem `json:"items"`
+	Title              string        `json:"title"`
+	Resolution         string        `json:"resolution"` // общее разрешение частей, по умолчанию 1280x720
+	FrameRate          float64       `json:"frameRate"`
+	Transition         string        `json:"transition"` // fade или пусто
+	TransitionDuration float64       `json:"transitionDuration"`
+	Resolutions        []string      `json:"resolutions"` // рендиции, по умолчанию Resolution
+	Timestamp          string        `json:"timestamp"`
+}
+
+// composeHandle склеивает видео и титульные карточки в новый исходник и отправляет его в сегментирование
+func composeHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Проверка метода запроса
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ComposeRequest
+	if r.Body == nil {
+		http.Error(w, "Please send a request body", 400)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if len(req.Items) == 0 {
+		http.Error(w, "Missing items", 400)
+		return
+	}
+
+	opts := ffmpeg.ComposeOptions{
+		FrameRate:          req.FrameRate,
+		Transition:         req.Transition,
+		TransitionDuration: req.TransitionDuration,
+	}
+	if req.Resolution == "" {
+		req.Resolution = "1280x720"
+	}
+	if _, err := fmt.Sscanf(req.Resolution, "%dx%d", &opts.Width, &opts.Height); err != nil || opts.Width <= 0 || opts.Height <= 0 {
+		http.Error(w, "Invalid resolution", 400)
+		return
+	}
+	if len(req.Resolutions) == 0 {
+		req.Resolutions = []string{req.Resolution}
+	}
+
+	// Исходники загружаются один раз, даже если видео повторяется
+	ctx := context.Background()
+	sources := map[string]string{}
+	items := []ffmpeg.ComposeItem{}
+	ids := []string{}
+	for n, item := range req.Items {
+		if item.Card != nil {
+			card := *item.Card
+			card.FontFile = os.Getenv("TITLE_FONT_FILE")
+			items = append(items, ffmpeg.ComposeItem{Card: &card})
+			continue
+		}
+		if item.Id == "" {
+			http.Error(w, fmt.Sprintf("item %d: missing id or card", n+1), 400)
+			return
+		}
+		source, ok := sources[item.Id]
+		if !ok {
+			parent := ParentVideo{}
+			if err := fb.GetVideoMetadata(ctx, item.Id, &parent); err != nil {
+				http.Error(w, fmt.Sprintf("item %d: %v", n+1, err), http.StatusNotFound)
+				return
+			}
+			var err error
+			source, err = downloadSource(ctx, parent)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer os.Remove(source)
+			sources[item.Id] = source
+			ids = append(ids, item.Id)
+		}
+		items = append(items, ffmpeg.ComposeItem{File: source})
+	}
+
+	composedDir := "composed"
+	tempFile, err := derivedTempFile(composedDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tempFile)
+
+	if err := ffmpeg.Compose(items, tempFile, opts); err != nil {
+		fmt.Println("Ошибка при склейке видео:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	derived := DerivedVideo{
+		File:        tempFile,
+		Dir:         composedDir,
+		Title:       req.Title,
+		Resolutions: req.Resolutions,
+		Timestamp:   req.Timestamp,
+		Metadata: map[string]interface{}{
+			"composedFrom": ids,
+			"composition":  req.Items,
+		},
+	}
+	id, url, err := publishDerivedVideo(ctx, derived)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(ClipResult{Success: true, Id: id, Url: url})
+}
+
+// ReframeRequest запрос на вертикальную или квадратную версию видео
+type ReframeRequest struct {
+	Id   string `json:"id"`
+	Hash string `json:"hash"`
+	reframe.Options
+}
+
+// Reframed версия видео с другим соотношением сторон
+type Reframed struct {
+	Aspect     string `json:"aspect" firestore:"aspect"`
+	Mode       string `json:"mode" firestore:"mode"`
+	Resolution string `json:"resolution" firestore:"resolution"`
+	Mp4        string `json:"mp4" firestore:"mp4"`
+}
+
+// reframeHandle создает MP4 с целевым соотношением сторон (9:16, 1:1) для сторис и шортс
+func reframeHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Проверка метода запроса
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ReframeRequest
+	if r.Body == nil {
+		http.Error(w, "Please send a request body", 400)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if req.Id == "" || req.Hash == "" {
+		http.Error(w, "id and hash are required", 400)
+		return
+	}
+	if req.Aspect == "" {
+		req.Aspect = "9:16"
+	}
+	if req.Mode == "" {
+		req.Mode = reframe.ModeCrop
+	}
+	width, height, err := req.Size()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	ctx := context.Background()
+	parent := ParentVideo{}
+	if err := fb.GetVideoMetadata(ctx, req.Id, &parent); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	source, err := downloadSource(ctx, parent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(source)
+
+	outputDirName := "output"
+	storageDirName := "videos"
+	if err := os.MkdirAll(outputDirName, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	aspect := strings.ReplaceAll(req.Aspect, ":", "x")
+	mp4Name := fmt.Sprintf("%v_%v_%v.mp4", req.Hash, aspect, req.Mode)
+	mp4Path := fmt.Sprintf("%v/%v", outputDirName, mp4Name)
+	if err := reframe.Reframe(source, mp4Path, req.Options); err != nil {
+		fmt.Println("Ошибка перекадрирования видео:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := fb.UploadFilesToFireStorage(ctx, []string{mp4Path}, storageDirName); err != nil {
+		fmt.Println("Ошибка при загрузке в Firestorage:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := Reframed{
+		Aspect:     req.Aspect,
+		Mode:       req.Mode,
+		Resolution: fmt.Sprintf("%vx%v", width, height),
+		Mp4:        "/" + ffmpeg.StorageUri(storageDirName+"/"+mp4Name),
+	}
+
+	// Запись метаданных в Firestore
+	metadata := map[string]interface{}{
+		"reframed": map[string]interface{}{
+			aspect: result,
+		},
+	}
+	if err := fb.UpdateVideoMetadata(ctx, metadata, req.Id); err != nil {
+		fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// downloadSource загружает исходный файл видео из Firestorage по тому же пути
+func downloadSource(ctx context.Context, parent ParentVideo) (string, error) {
+	source := parent.sourcePath()
+	if err := os.MkdirAll(filepath.Dir(source), 0755); err != nil {
+		return "", err
+	}
+	if err := fb.DownloadVideo(ctx, source); err != nil {
+		return "", err
+	}
+	return source, nil
+}
+
+// derivedTempFile временный файл для нового исходника в папке dir
+func derivedTempFile(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp(dir, "tmp_*.mp4")
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	return file.Name(), nil
+}
+
+// DerivedVideo новое видео, собранное из существующих (фрагмент, склейка)
+type DerivedVideo struct {
+	File        string // собранный локальный файл
+	Dir         string // папка исходника в Firestorage
+	Title       string
+	Parent      string
+	Resolutions []string
+	Timestamp   string
+	Metadata    map[string]interface{} // дополнительные поля документа
+}
+
+// publishDerivedVideo создает документ нового видео, прогоняет файл через сегментирование
+// и загружает его в Firestorage как исходник. Возвращает id документа и ссылку на манифест
+func publishDerivedVideo(ctx context.Context, derived DerivedVideo) (string, string, error) {
+	hash, err := method.GenerateFileHash(derived.File)
+	if err != nil {
+		return "", "", err
+	}
+	sourceFile := fmt.Sprintf("%v/%v.mp4", derived.Dir, hash)
+	if err := os.Rename(derived.File, sourceFile); err != nil {
+		return "", "", err
+	}
+
+	ref, err := fb.SaveVideoMetadata(ctx, fb.VideoMetadata{
+		Title:   derived.Title,
+		Name:    hash,
+		Hash:    hash,
+		Extname: "mp4",
+		Parent:  derived.Parent,
+	}, "videos")
+	if err != nil {
+		os.Remove(sourceFile)
+		return "", "", err
+	}
+
+	timestamp := derived.Timestamp
+	if timestamp == "" {
+		timestamp = "00:00:01"
+	}
+	url, err := segmentVideo(ctx, Video{
+		Hash:        hash,
+		Name:        sourceFile,
+		Resolutions: derived.Resolutions,
+		Id:          ref.ID,
+		Timestamp:   timestamp,
+	})
+	if err != nil {
+		os.Remove(sourceFile)
+		return "", "", err
+	}
+
+	// Собранный файл становится исходником нового видео
+	if _, err := fb.UploadFilesToFireStorage(ctx, []string{sourceFile}, derived.Dir); err != nil {
+		fmt.Println("Ошибка при загрузке в Firestorage:", err)
+	}
+	metadata := map[string]interface{}{
+		"storage": true,
+	}
+	for key, value := range derived.Metadata {
+		metadata[key] = value
+	}
+	if err := fb.UpdateVideoMetadata(ctx, metadata, ref.ID); err != nil {
+		fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
+	}
+
+	return ref.ID, url, nil
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+type VideoRequest struct {
+	Resolutions []string             `json:"resolutions"`
+	Chapters    []fb.Chapter         `json:"chapters"`
+	Audio       *ffmpeg.AudioOptions `json:"audio"`
+	Watermark   *ffmpeg.Watermark    `json:"watermark"`
+	Creator     string               `json:"creator"`
+	Deinterlace string               `json:"deinterlace"` // bwdif (по умолчанию) или yadif
+}
+
+type ProgressData = ffmpeg.ProgressData
+
+// watermarksCollection водяные знаки авторов в Firestore, id документа — автор
+var watermarksCollection = "watermarks"
+
+// resolveWatermark водяной знак задания, иначе водяной знак автора.
+// Изображение загружается из Firestorage во временный файл; nil — без водяного знака
+func resolveWatermark(ctx context.Context, job *ffmpeg.Watermark, creator string) *ffmpeg.Watermark {
+	watermark := job
+	if watermark == nil && creator != "" {
+		watermark = &ffmpeg.Watermark{}
+		if err := fb.GetDocument(ctx, watermarksCollection, creator, watermark); err != nil {
+			fmt.Printf("Водяной знак автора %v не найден: %v\n", creator, err)
+			return nil
+		}
+	}
+	if watermark == nil || watermark.Image == "" {
+		return nil
+	}
+
+	file, err := os.CreateTemp("", "watermark_*"+filepath.Ext(watermark.Image))
+	if err != nil {
+		fmt.Printf("Ошибка создания временного файла: %v\n", err)
+		return nil
+	}
+	file.Close()
+	if err := fb.DownloadFile(ctx, watermark.Image, file.Name()); err != nil {
+		fmt.Printf("Ошибка загрузки водяного знака %v: %v\n", watermark.Image, err)
+		os.Remove(file.Name())
+		return nil
+	}
+
+	result := *watermark
+	result.File = file.Name()
+	return &result
+}
+
+// audioEncodeOptions измеряет громкость для двухпроходной нормализации.
+// Если измерить не удалось, звук только очищается фильтрами без loudnorm
+func audioEncodeOptions(input string, audio *ffmpeg.AudioOptions) ffmpeg.EncodeOptions {
+	opts := ffmpeg.EncodeOptions{Audio: audio}
+	if audio == nil || !audio.Normalize {
+		return opts
+	}
+
+	stats, err := ffmpeg.MeasureLoudness(input, *audio)
+	if err != nil {
+		fmt.Printf("Ошибка измерения громкости %v: %v\n", input, err)
+		normalized := *audio
+		normalized.Normalize = false
+		opts.Audio = &normalized
+		return opts
+	}
+	opts.Loudness = stats
+	return opts
+}
+
+func convertVideoHandler(w http.ResponseWriter, r *http.Request) {
+
+	idToken := r.URL.Query().Get("token")
+	if idToken == "" {
+		http.Error(w, "Missing token", http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Ошибка апгрейда соединения:", err)
+		return
+	}
+	defer conn.Close()
+
+	claims, err := fb.IsAuthAdmin(context.Background(), idToken)
+	if err != nil {
+		method.ErrorMessageWS(conn, err, "Ошибка авторизации")
+		return
+	}
+
+	if len(claims) == 0 {
+		method.ErrorMessageWS(conn, err, "Ошибка авторизации")
+		return
+	}
+
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		// log.Println("Ошибка чтения сообщения из WebSocket:", err)
+		method.ErrorMessageWS(conn, err, "Ошибка чтения сообщения из WebSocket:")
+	}
+
+	var req VideoRequest
+	err = json.Unmarshal(message, &req)
+	if err != nil {
+		method.ErrorMessageWS(conn, err, "Ошибка декодирования JSON:")
+		// log.Println("Ошибка декодирования JSON:", err)
+	}
+
+	// Create a temporary file for the uploaded video
+	tempFile, err := os.CreateTemp("", "video_*.mp4")
+	if err != nil {
+		// log.Println("Ошибка создания временного файла:", err)
+		method.ErrorMessageWS(conn, err, "Ошибка создания временного файла:")
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	// Read video data from WebSocket and write to the temp file
+	for {
+		_, videoData, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				break
+			}
+			log.Println("Ошибка чтения видео данных из WebSocket:", err)
+			return
+		}
+
+		if len(videoData) == 0 {
+			// Empty message indicates end of transmission
+			break
+		}
+
+		_, err = tempFile.Write(videoData)
+		if err != nil {
+			log.Println("Ошибка записи видео данных во временный файл:", err)
+			return
+		}
+	}
+
+	// Close temp file to ensure all data is flushed to disk
+	err = tempFile.Close()
+	if err != nil {
+		log.Println("Ошибка закрытия временного файла:", err)
+		return
+	}
+
+	// Generate hash of the uploaded video
+	hash, err := method.GenerateFileHash(tempFile.Name())
+	if err != nil {
+		log.Println("ошибка при генерации хеша файла:", err)
+		return
+	}
+	outputDirName := "output"
+	storageDirName := "videos"
+
+	// Общий прогресс: нормализация, измерение громкости и кодирование каждого разрешения
+	stages := []ffmpeg.Stage{ffmpeg.NormalizeStage}
+	if req.Audio != nil && req.Audio.Normalize {
+		stages = append(stages, ffmpeg.LoudnessStage)
+	}
+	for _, resolution := range req.Resolutions {
+		stages = append(stages, ffmpeg.EncodeStage(resolution))
+	}
+	progress := ffmpeg.NewTracker(conn, stages...)
+
+	// Имена файлов остаются по хешу загруженного видео, кодируется нормализованное
+	inputFile, ingest := normalizeSource(tempFile.Name(), req.Deinterlace, progress)
+	if inputFile != tempFile.Name() {
+		defer os.Remove(inputFile)
+	}
+	progress.Complete(ffmpeg.NormalizeStage.Name)
+
+	encodeOptions := audioEncodeOptions(inputFile, req.Audio)
+	progress.Complete(ffmpeg.LoudnessStage.Name)
+	encodeOptions.Hash = hash
+	encodeOptions.Progress = progress
+	encodeOptions.Watermark = resolveWatermark(context.Background(), req.Watermark, req.Creator)
+	if encodeOptions.Watermark != nil {
+		defer os.Remove(encodeOptions.Watermark.File)
+	}
+
+	// Главы проверяются по длительности загруженного видео
+	if len(req.Chapters) > 0 {
+		duration, err := ffmpeg.GetVideoDuration(inputFile)
+		if err != nil {
+			method.ErrorMessageWS(conn, err, "Ошибка при получении продолжительности видео:")
+			return
+		}
+		spans, err := chapters.Validate(req.Chapters, duration)
+		if err != nil {
+			method.ErrorMessageWS(conn, err, "Ошибка в главах:")
+			return
+		}
+		req.Chapters = chapters.ToChapters(spans)
+		encodeOptions.Chapters = toEncodeChapters(spans)
+	}
+
+	// Check if a file with the same hash already exists
+	for n, resolution := range req.Resolutions {
+
+		parts := strings.Split(resolution, "x")
+		if len(parts) != 2 {
+			return
+		}
+
+		width := parts[0]
+		height := parts[1]
+
+		outputFileName := fmt.Sprintf("%s/%s_%s_%s.mp4", outputDirName, hash, width, height)
+		objectName := fmt.Sprintf("%s/%s_%s_%s.mp4", storageDirName, hash, width, height)
+		outputFilesName := []string{outputFileName}
+		if err := os.MkdirAll(outputDirName, 0755); err != nil {
+			log.Fatal("Ошибка при создании папки для сегментов:", err)
+		}
+
+		// проверяем загружен ли файл в firestorage
+		exists, err := fb.FileExistsInFirestorage(objectName)
+		if err != nil {
+			fmt.Printf("Error checking file existence: %v\n", err)
+		} else if exists {
+			fmt.Printf("Файл уже загружен в Firestorage: %s\n", outputFileName)
+			result := method.ErrorSW{
+				Success: false,
+				Error:   "File was load",
+				Message: fmt.Sprintf("Файл уже загружен в Firestorage: %s", outputFileName),
+			}
+
+			bytes, err := json.Marshal(result)
+			if err != nil {
+				log.Printf("Error sending progress message: %v", err)
+				break
+			}
+
+			conn.WriteMessage(websocket.TextMessage, bytes)
+			return
+		} else {
+			fmt.Printf("File %v does not exist in the bucket.\n", objectName)
+		}
+
+		// проверяем загружен ли файл локально
+		log.Println(outputFileName)
+		if _, err := os.Stat(outputFileName); err == nil {
+			// File already exists
+			log.Println("Файл уже загружен на сервер:", outputFileName)
+			result := ProgressData{
+				Success:          false,
+				Error:            fmt.Sprintf("Файл уже загружен на сервер: %s", outputFileName),
+				Resolutions:      n,
+				TotalResolutions: len(req.Resolutions),
+				Size:             parts,
+			}
+
+			bytes, err := json.Marshal(result)
+			if err != nil {
+				log.Printf("Error sending progress message: %v", err)
+				break
+			}
+			conn.WriteMessage(websocket.TextMessage, bytes)
+
+			// значит не будем конвертировать и грузим в Firestorage
+			if _, err := fb.UploadFilesToFireStorage(context.Background(), outputFilesName, storageDirName); err != nil {
+				fmt.Printf("Failed to upload file: %v\n", err)
+			} else {
+				fmt.Println("Файл загружен в Firestorage")
+			}
+			return
+		}
+
+		// Convert the video
+		err = ffmpeg.ConvertVideo(inputFile, req.Resolutions, conn, encodeOptions)
+		if err != nil {
+			log.Println("Ошибка конвертации видео:", err)
+			return
+		}
+
+		// Создание метаданных
+		metadata := fb.VideoMetadata{
+			Title:    "",
+			Name:     fmt.Sprintf("%s_%s_%s", hash, width, height),
+			Hash:     hash,
+			Extname:  "mp4",
+			Storage:  false,
+			Segments: false,
+			Poster:   "",
+			Url:      "",
+			Chapters: req.Chapters,
+		}
+		if encodeOptions.Loudness != nil {
+			metadata.Loudness = encodeOptions.Loudness
+		}
+		if ingest != nil {
+			metadata.Ingest = ingest
+		}
+
+		_, err = fb.UploadFilesToFireStorage(context.Background(), outputFilesName, storageDirName)
+		if err != nil {
+			fmt.Printf("Failed to upload file: %v\n", err)
+		} else {
+			metadata.Storage = true
+			fmt.Println("Файл загружен в Firestorage")
+		}
+
+		// Запись метаданных в Firestore
+		_, err = fb.SaveVideoMetadata(context.Background(), metadata, "videos")
+		if err != nil {
+			fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
+		}
+	}
+
+}
+
+type PosterData struct {
+	Video     string `json:"video"`
+	Timestamp string `json:"timestamp"`
+}
+
+func creatPosterHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Проверка метода запроса
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var m PosterData
+
+	if r.Body == nil {
+		http.Error(w, "Please send a request body", 400)
+		return
+	}
+	err := json.NewDecoder(r.Body).Decode(&m)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	fmt.Println(m)
+
+	if err := fb.DownloadVideo(context.Background(), m.Video); err != nil {
+		fmt.Printf("Failed to download video file:  %v", err)
+	}
+	outputDir := "posters"
+	res, err := ffmpeg.CreatePoster(m.Video, outputDir, m.Timestamp, "poster")
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	println(res)
+	// Возврат успешного ответа
+	responseMessage := fmt.Sprintf("Видео, %v! Time: %v", m.Video, m.Timestamp)
+	responseData := OutputData{
+		Message: responseMessage,
+		Status:  http.StatusOK,
+		Url:     m.Video,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(responseData)
+}
+
+type Chapters struct {
+	Chapters []fb.Chapter `json:"chapters"`
+	Id       string       `json:"id"`
+	Hash     string       `json:"hash"`
+	Language string       `json:"language"`
+}
+
+func createVTTHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Проверка метода запроса
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var fl Chapters
+
+	if r.Body == nil {
+		http.Error(w, "Please send a request body", 400)
+		return
+	}
+	err := json.NewDecoder(r.Body).Decode(&fl)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	fmt.Println(fl)
+	if fl.Language == "" {
+		fl.Language = "ru"
+	}
+
+	// Проверка глав по длительности видео
+	stream := StreamMetadata{}
+	if fl.Id != "" {
+		if err := fb.GetVideoMetadata(context.Background(), fl.Id, &stream); err != nil {
+			fmt.Printf("Ошибка чтения метаданных из Firestore: %v\n", err)
+		}
+	}
+	spans, err := chapters.Validate(fl.Chapters, stream.Duration)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	fl.Chapters = chapters.ToChapters(spans)
+
+	// Создание VTT файла
+	folderDir := fmt.Sprintf("segments/%v", fl.Hash)
+	if err := os.MkdirAll(folderDir, 0755); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	outputPath := fmt.Sprintf("%v/%v.vtt", folderDir, fl.Hash)
+	err = createVTTFile(fl.Chapters, outputPath)
+	if err != nil {
+		fmt.Printf("Error creating VTT file: %v\n", err)
+		return
+	}
+
+	// Главы для HLS (#EXT-X-SESSION-DATA)
+	chaptersName := fmt.Sprintf("%v_chapters.json", fl.Hash)
+	chaptersPath := fmt.Sprintf("%v/%v", folderDir, chaptersName)
+	if err := ffmpeg.WriteHLSChapters(toEncodeChapters(spans), fl.Language, chaptersPath); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	if _, err := fb.UploadFilesToFireStorage(context.Background(), []string{chaptersPath}, folderDir); err != nil {
+		fmt.Println("Ошибка при загрузке в Firestorage:", err)
+	}
+
+	// Создание метаданных
+	metadata := map[string]interface{}{
+		"chapters":         fl.Chapters,
+		"chaptersUri":      ffmpeg.StorageUri(chaptersPath),
+		"chaptersLanguage": fl.Language,
+	}
+	// Запись метаданных в Firestore
+	err = fb.UpdateVideoMetadata(context.Background(), metadata, fl.Id)
+	if err != nil {
+		fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
+	}
+
+	// Главы как дорожка субтитров HLS
+	rendition := ffmpeg.MediaRendition{
+		Language: fl.Language,
+		Name:     "Главы",
+	}
+	if err := addSubtitleRendition(context.Background(), fl.Id, fl.Hash, outputPath, rendition); err != nil {
+		fmt.Println("Ошибка при создании дорожки глав:", err)
+	}
+
+	files := []string{outputPath}
+
+	_, err = fb.UploadFilesToFireStorage(context.Background(), files, folderDir)
+	if err != nil {
+		fmt.Println("Ошибка при загрузке в Firestorage:", err)
+	}
+
+	// println(res)
+	// Возврат успешного ответа
+	responseMessage := fmt.Sprintf("good %v", 0)
+	responseData := OutputData{
+		Message: responseMessage,
+		Status:  http.StatusOK,
+		Url:     "",
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(responseData)
+}
+
+type ChapterSuggestRequest struct {
+	Id         string           `json:"id"`
+	Hash       string           `json:"hash"`
+	Transcript string           `json:"transcript"`
+	Video      string           `json:"video"` // видео в Firestorage для поиска смен сцен, необязательно
+	Options    chapters.Options `json:"options"`
+}
+
+var sceneThreshold = 0.4
+
+// suggestChaptersHandle предлагает главы по транскрипции. Ответ в формате /vttfile:
+// принятые администратором главы отправляются туда без изменений
+func suggestChaptersHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Проверка метода запроса
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var m ChapterSuggestRequest
+
+	if r.Body == nil {
+		http.Error(w, "Please send a request body", 400)
+		return
+	}
+	err := json.NewDecoder(r.Body).Decode(&m)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	segments, err := subtitles.ReadTranscript(m.Transcript)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	stream := StreamMetadata{}
+	if m.Id != "" {
+		if err := fb.GetVideoMetadata(context.Background(), m.Id, &stream); err != nil {
+			fmt.Printf("Ошибка чтения метаданных из Firestore: %v\n", err)
+		}
+	}
+
+	// Смены сцен
+	scenes := []float64{}
+	if m.Video != "" {
+		if err := fb.DownloadVideo(context.Background(), m.Video); err != nil {
+			fmt.Printf("Failed to download video file:  %v", err)
+		} else {
+			scenes, err = ffmpeg.DetectScenes(m.Video, sceneThreshold)
+			if err != nil {
+				fmt.Printf("Ошибка поиска смен сцен: %v\n", err)
+			}
+			if err := method.RemoveLocalFile(m.Video); err != nil {
+				fmt.Printf("Ошибка удаления видео %v:  %v\n", m.Video, err)
+			}
+		}
+	}
+
+	suggested, err := chapters.Suggest(segments, scenes, stream.Duration, m.Options)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Сохраняем предложение, чтобы администратор мог принять его позже
+	if m.Id != "" {
+		metadata := map[string]interface{}{
+			"chapterSuggestions": suggested,
+		}
+		if err := fb.UpdateVideoMetadata(context.Background(), metadata, m.Id); err != nil {
+			fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
+		}
+	}
+
+	result := Chapters{
+		Chapters: suggested,
+		Id:       m.Id,
+		Hash:     m.Hash,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(result)
+}
+
+func createVTTFile(chapters []fb.Chapter, outputPath string) error {
+	// Создание и открытие файла
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	// Запись заголовка VTT
+	_, err = file.WriteString("WEBVTT\n\n")
+	if err != nil {
+		return fmt.Errorf("failed to write to file: %w", err)
+	}
+
+	// Запись субтитров
+	for _, chapters := range chapters {
+		_, err := file.WriteString(fmt.Sprintf("%s --> %s\n%s\n\n", chapters.Start, chapters.End, chapters.Text))
+		if err != nil {
+			return fmt.Errorf("failed to write subtitle to file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type SubtitlesRequest struct {
+	Id         string             `json:"id"`
+	Hash       string             `json:"hash"`
+	Transcript string             `json:"transcript"`
+	Language   string             `json:"language"`
+	Default    bool               `json:"default"`
+	Options    subtitles.Options  `json:"options"`
+	Karaoke    bool               `json:"karaoke"` // пословная подсветка: WebVTT с тегами времени и ASS
+	Style      subtitles.ASSStyle `json:"style"`
+}
+
+// StreamMetadata данные видео в Firestore, нужные для пересборки мастер-манифеста
+type StreamMetadata struct {
+	Hash      string                  `firestore:"hash"`
+	Duration  float64                 `firestore:"duration"`
+	Variants  []ffmpeg.Variant        `firestore:"variants"`
+	Subtitles []ffmpeg.MediaRendition `firestore:"subtitles"`
+	Audio     []ffmpeg.MediaRendition `firestore:"audio"`
+	// JSON глав для #EXT-X-SESSION-DATA
+	ChaptersUri      string `firestore:"chaptersUri"`
+	ChaptersLanguage string `firestore:"chaptersLanguage"`
+	// Язык речи, определенный перед распознаванием
+	Language string `firestore:"language"`
+}
+
+// master содержимое мастер-манифеста по метаданным видео
+func (s StreamMetadata) master() ffmpeg.MasterPlaylist {
+	master := ffmpeg.MasterPlaylist{
+		Variants:  s.Variants,
+		Subtitles: s.Subtitles,
+		Audio:     s.Audio,
+	}
+	if s.ChaptersUri != "" {
+		master.SessionData = append(master.SessionData, ffmpeg.SessionData{
+			DataId:   ffmpeg.ChaptersDataId,
+			Uri:      s.ChaptersUri,
+			Language: s.ChaptersLanguage,
+		})
+	}
+	return master
+}
+
+// toEncodeChapters переводит проверенные главы в формат ffmpeg
+func toEncodeChapters(spans []chapters.Span) []ffmpeg.Chapter {
+	result := make([]ffmpeg.Chapter, len(spans))
+	for i, span := range spans {
+		result[i] = ffmpeg.Chapter{Start: span.Start, End: span.End, Title: span.Title}
+	}
+	return result
+}
+
+var languageNames = map[string]string{
+	"ru": "Русский",
+	"be": "Беларуская",
+	"pl": "Polski",
+	"en": "English",
+}
+
+// languageName название языка для меню плеера
+func languageName(language string) string {
+	if name, ok := languageNames[language]; ok {
+		return name
+	}
+	return language
+}
+
+// rebuildMasterM3U8 пересобирает мастер-манифест по метаданным и загружает его в Firestorage
+func rebuildMasterM3U8(ctx context.Context, stream StreamMetadata) error {
+	if len(stream.Variants) == 0 {
+		// Сегменты еще не созданы, манифест соберется вместе с ними
+		return nil
+	}
+	folderDir := fmt.Sprintf("segments/%v", stream.Hash)
+	if err := os.MkdirAll(folderDir, 0755); err != nil {
+		return err
+	}
+
+	manifest := fmt.Sprintf("%v/%v.m3u8", folderDir, stream.Hash)
+	if err := ffmpeg.CreateMasterM3U8(manifest, stream.master()); err != nil {
+		return err
+	}
+
+	_, err := fb.UploadFilesToFireStorage(ctx, []string{manifest}, folderDir)
+	return err
+}
+
+// addSubtitleRendition режет VTT на сегменты HLS и добавляет дорожку в мастер-манифест
+func addSubtitleRendition(ctx context.Context, id, hash, vttPath string, rendition ffmpeg.MediaRendition) error {
+	stream := StreamMetadata{}
+	if id != "" {
+		if err := fb.GetVideoMetadata(ctx, id, &stream); err != nil {
+			return err
+		}
+	}
+	stream.Hash = hash
+
+	cues, err := subtitles.ReadVTT(vttPath)
+	if err != nil {
+		return err
+	}
+
+	folderDir := fmt.Sprintf("segments/%v", hash)
+	outputPrefix := strings.TrimSuffix(vttPath, filepath.Ext(vttPath)) + "_sub_"
+	playlist, err := subtitles.CreateSegments(cues, outputPrefix, ffmpeg.SegmentDuration(), stream.Duration)
+	if err != nil {
+		return err
+	}
+	if err := ffmpeg.EditFile(playlist); err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob(outputPrefix + "*")
+	if err != nil {
+		return err
+	}
+	if _, err := fb.UploadFilesToFireStorage(ctx, files, folderDir); err != nil {
+		return err
+	}
+
+	rendition.Type = ffmpeg.SubtitlesMediaType
+	rendition.GroupId = ffmpeg.SubtitlesGroupId
+	rendition.Uri = ffmpeg.StorageUri(playlist)
+
+	// Заменяем дорожку с тем же адресом или добавляем новую.
+	// В группе может быть только одна дорожка по умолчанию
+	renditions := []ffmpeg.MediaRendition{}
+	for _, existing := range stream.Subtitles {
+		if existing.Uri != rendition.Uri {
+			if rendition.Default {
+				existing.Default = false
+			}
+			renditions = append(renditions, existing)
+		}
+	}
+	stream.Subtitles = append(renditions, rendition)
+
+	if id == "" {
+		return nil
+	}
+	metadata := map[string]interface{}{
+		"subtitles": stream.Subtitles,
+	}
+	if err := fb.UpdateVideoMetadata(ctx, metadata, id); err != nil {
+		return err
+	}
+
+	return rebuildMasterM3U8(ctx, stream)
+}
+
+// segmentUrl ссылка на файл в папке сегментов видео в Firestorage
+func segmentUrl(hash, fileName string) string {
+	return "/segments%2F" + hash + "%2F" + fileName + "?alt=media"
+}
+
+// LadderMetadata выбранная лестница битрейтов и результаты анализа для аудита
+type LadderMetadata struct {
+	Analysis ladder.Analysis `json:"analysis" firestore:"analysis"`
+	Rungs    []ladder.Rung   `json:"rungs" firestore:"rungs"`
+}
+
+// buildLadder анализирует сложность видео пробными кодированиями и строит лестницу битрейтов
+func buildLadder(input string, duration float64, resolutions []string, opts ladder.Options) (*LadderMetadata, error) {
+	analysis, err := ladder.Analyze(input, duration, opts)
+	if err != nil {
+		return nil, err
+	}
+	rungs, err := ladder.Build(analysis, resolutions, opts)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Сложность видео %v: %.2f, лестница: %v\n", input, analysis.Complexity, rungs)
+	return &LadderMetadata{Analysis: analysis, Rungs: rungs}, nil
+}
+
+// checkQuality оценивает качество каждой рендиции; ошибки отдельных рендиций не прерывают проверку
+func checkQuality(source string, variants []ffmpeg.Variant, outputs []string, opts quality.Options) []quality.Report {
+	reports := []quality.Report{}
+	for i, variant := range variants {
+		report, err := quality.Evaluate(source, outputs[i], variant, opts)
+		if err != nil {
+			fmt.Printf("Ошибка проверки качества %v %v: %v\n", variant.Resolution, variant.Codec, err)
+			continue
+		}
+		if report.Flagged {
+			fmt.Printf("Качество рендиции %v %v ниже порога: %+v\n", variant.Resolution, variant.Codec, report.Quality)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func qualityFlagged(reports []quality.Report) bool {
+	for _, report := range reports {
+		if report.Flagged {
+			return true
+		}
+	}
+	return false
+}
+
+// QualityResponse отчеты о качестве рендиций видео
+type QualityResponse struct {
+	Id      string           `json:"id"`
+	Reports []quality.Report `json:"reports" firestore:"quality"`
+	Flagged bool             `json:"flagged" firestore:"qualityFlagged"`
+}
+
+// qualityHandle возвращает отчеты о качестве рендиций: GET /quality?id=...
+func qualityHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Проверка метода запроса
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing id", 400)
+		return
+	}
+
+	result := QualityResponse{}
+	if err := fb.GetVideoMetadata(context.Background(), id, &result); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	result.Id = id
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// videoCodecs список кодеков для сегментов: H.264 всегда первый, повторы отбрасываются
+func videoCodecs(extra []string) []string {
+	result := []string{ffmpeg.CodecH264}
+	for _, codec := range extra {
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		if !slices.Contains(result, codec) {
+			result = append(result, codec)
+		}
+	}
+	return result
+}
+
+// createAudioRenditions создает аудио-рендиции AAC для дорожек видео.
+// Без явного списка дорожек используется первая звуковая дорожка исходника
+func createAudioRenditions(video Video, folder, language string, opts ffmpeg.EncodeOptions) []ffmpeg.MediaRendition {
+	count, err := ffmpeg.AudioStreams(video.Name)
+	if err != nil {
+		fmt.Printf("Ошибка при получении звуковых дорожек %v: %v\n", video.Name, err)
+		return nil
+	}
+
+	tracks := video.AudioTracks
+	if len(tracks) == 0 {
+		if count == 0 {
+			return nil
+		}
+		tracks = []ffmpeg.AudioTrack{{Language: language, Default: true}}
+	}
+
+	renditions := []ffmpeg.MediaRendition{}
+	for n, track := range tracks {
+		input, stream, trackOptions := video.Name, track.Stream, opts
+		if track.Source != "" {
+			if err := fb.DownloadVideo(context.Background(), track.Source); err != nil {
+				fmt.Printf("Ошибка загрузки звуковой дорожки %v: %v\n", track.Source, err)
+				continue
+			}
+			input, stream = track.Source, 0
+			trackOptions = audioEncodeOptions(track.Source, video.Audio)
+		} else if track.Stream < 0 || track.Stream >= count {
+			fmt.Printf("Звуковой дорожки %v нет в видео %v\n", track.Stream, video.Name)
+			continue
+		}
+
+		name := fmt.Sprintf("%v_audio_%v_", video.Hash, n)
+		err := ffmpeg.CreateAudioSegments(input, fmt.Sprintf("%v/%v", folder, name), stream, trackOptions)
+		// Загруженная дорожка больше не нужна
+		if track.Source != "" {
+			method.RemoveLocalFile(track.Source)
+		}
+		if err != nil {
+			fmt.Printf("Ошибка при создании звуковых сегментов %v: %v\n", name, err)
+			continue
+		}
+
+		title := track.Name
+		if title == "" && track.Language != "" {
+			title = languageName(track.Language)
+		}
+		if title == "" {
+			title = fmt.Sprintf("Дорожка %v", n+1)
+		}
+		renditions = append(renditions, ffmpeg.MediaRendition{
+			Type:       ffmpeg.AudioMediaType,
+			GroupId:    ffmpeg.AudioGroupId,
+			Language:   track.Language,
+			Name:       title,
+			Uri:        ffmpeg.StorageUri(folder + "/" + name + ".m3u8"),
+			Default:    track.Default,
+			AutoSelect: true,
+		})
+	}
+
+	// В группе должна быть ровно одна дорожка по умолчанию
+	hasDefault := false
+	for i := range renditions {
+		if renditions[i].Default && hasDefault {
+			renditions[i].Default = false
+		}
+		hasDefault = hasDefault || renditions[i].Default
+	}
+	if !hasDefault && len(renditions) > 0 {
+		renditions[0].Default = true
+	}
+
+	return renditions
+}
+
+// publishSubtitles записывает реплики в WebVTT/SRT (и караоке), добавляет дорожку HLS,
+// загружает файлы рядом с сегментами и сохраняет ссылки в метаданных
+func publishSubtitles(ctx context.Context, m SubtitlesRequest, cues []subtitles.Cue) (map[string]string, error) {
+	// Субтитры кладем рядом с HLS
+	folderDir := fmt.Sprintf("segments/%v", m.Hash)
+	if err := os.MkdirAll(folderDir, 0755); err != nil {
+		return nil, err
+	}
+	vttName := fmt.Sprintf("%v_%v.vtt", m.Hash, m.Language)
+	srtName := fmt.Sprintf("%v_%v.srt", m.Hash, m.Language)
+	vttPath := fmt.Sprintf("%v/%v", folderDir, vttName)
+	srtPath := fmt.Sprintf("%v/%v", folderDir, srtName)
+
+	if err := subtitles.WriteVTT(cues, vttPath); err != nil {
+		return nil, err
+	}
+	if err := subtitles.WriteSRT(cues, srtPath); err != nil {
+		return nil, err
+	}
+
+	// Дорожка субтитров HLS
+	rendition := ffmpeg.MediaRendition{
+		Language:   m.Language,
+		Name:       languageName(m.Language),
+		Default:    m.Default,
+		AutoSelect: true,
+	}
+	if err := addSubtitleRendition(ctx, m.Id, m.Hash, vttPath, rendition); err != nil {
+		fmt.Println("Ошибка при создании дорожки субтитров:", err)
+	}
+
+	files := []string{vttPath, srtPath}
+	captions := map[string]string{
+		"vtt": segmentUrl(m.Hash, vttName),
+		"srt": segmentUrl(m.Hash, srtName),
+	}
+
+	if m.Karaoke {
+		karaokeName := fmt.Sprintf("%v_%v_karaoke.vtt", m.Hash, m.Language)
+		assName := fmt.Sprintf("%v_%v.ass", m.Hash, m.Language)
+		karaokePath := fmt.Sprintf("%v/%v", folderDir, karaokeName)
+		assPath := fmt.Sprintf("%v/%v", folderDir, assName)
+
+		if err := subtitles.WriteKaraokeVTT(cues, karaokePath); err != nil {
+			return nil, err
+		}
+		if err := subtitles.WriteASS(cues, m.Style, assPath); err != nil {
+			return nil, err
+		}
+		files = append(files, karaokePath, assPath)
+		captions["karaoke"] = segmentUrl(m.Hash, karaokeName)
+		captions["ass"] = segmentUrl(m.Hash, assName)
+	}
+
+	_, err := fb.UploadFilesToFireStorage(ctx, files, folderDir)
+	if err != nil {
+		fmt.Println("Ошибка при загрузке в Firestorage:", err)
+	}
+
+	// Запись метаданных в Firestore
+	if m.Id != "" {
+		metadata := map[string]interface{}{
+			"captions": map[string]interface{}{
+				m.Language: captions,
+			},
+		}
+		err = fb.UpdateVideoMetadata(ctx, metadata, m.Id)
+		if err != nil {
+			fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
+		}
+	}
+
+	return captions, nil
+}
+
+// BurnRequest запрос на видео с впечатанными субтитрами (открытые субтитры)
+type BurnRequest struct {
+	Id         string             `json:"id"`
+	Hash       string             `json:"hash"`
+	Language   string             `json:"language"`   // дорожка субтитров, созданная через /subtitles
+	Resolution string             `json:"resolution"` // по умолчанию 1280x720
+	Style      subtitles.ASSStyle `json:"style"`      // шрифт, размер, обводка и положение
+	HLS        bool               `json:"hls"`        // дополнительно отдельный HLS-манифест
+}
+
+// OpenCaptions рендиция с впечатанными субтитрами
+type OpenCaptions struct {
+	Language   string `json:"language" firestore:"language"`
+	Resolution string `json:"resolution" firestore:"resolution"`
+	Mp4        string `json:"mp4" firestore:"mp4"`
+	Hls        string `json:"hls,omitempty" firestore:"hls,omitempty"`
+}
+
+// burnSubtitlesHandle создает MP4 (и при необходимости HLS) с впечатанными субтитрами
+func burnSubtitlesHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Проверка метода запроса
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var m BurnRequest
+	if r.Body == nil {
+		http.Error(w, "Please send a request body", 400)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if m.Id == "" || m.Hash == "" {
+		http.Error(w, "id and hash are required", 400)
+		return
+	}
+	if m.Resolution == "" {
+		m.Resolution = "1280x720"
+	}
+	size := strings.Split(m.Resolution, "x")
+	if len(size) != 2 {
+		http.Error(w, "Invalid resolution", 400)
+		return
+	}
+
+	ctx := context.Background()
+	parent := ParentVideo{}
+	if err := fb.GetVideoMetadata(ctx, m.Id, &parent); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// Язык дорожки берется из определенного языка речи
+	if m.Language == "" {
+		stream := StreamMetadata{}
+		if err := fb.GetVideoMetadata(ctx, m.Id, &stream); err != nil {
+			fmt.Printf("Ошибка чтения метаданных из Firestore: %v\n", err)
+		}
+		m.Language = stream.Language
+	}
+	if m.Language == "" {
+		m.Language = "ru"
+	}
+
+	// Дорожка субтитров загружается из Firestorage
+	folderDir := fmt.Sprintf("segments/%v", m.Hash)
+	if err := os.MkdirAll(folderDir, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	vttPath := fmt.Sprintf("%v/%v_%v.vtt", folderDir, m.Hash, m.Language)
+	if err := fb.DownloadVideo(ctx, vttPath); err != nil {
+		http.Error(w, fmt.Sprintf("subtitles %v not found: %v", m.Language, err), http.StatusNotFound)
+		return
+	}
+	cues, err := subtitles.ReadVTT(vttPath)
+	os.Remove(vttPath)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Без караоке: текст рисуется основным цветом стиля
+	if m.Style.PrimaryColour == "" {
+		m.Style.PrimaryColour = "&H00FFFFFF"
+	}
+	name := fmt.Sprintf("%v_open_%v", m.Hash, m.Language)
+	assPath := fmt.Sprintf("%v/%v.ass", folderDir, name)
+	if err := subtitles.WriteASS(cues, m.Style, assPath); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(assPath)
+
+	source, err := downloadSource(ctx, parent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(source)
+
+	outputDirName := "output"
+	storageDirName := "videos"
+	if err := os.MkdirAll(outputDirName, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mp4Name := fmt.Sprintf("%v_%v_%v_open_%v.mp4", m.Hash, size[0], size[1], m.Language)
+	mp4Path := fmt.Sprintf("%v/%v", outputDirName, mp4Name)
+	if err := ffmpeg.BurnSubtitles(source, assPath, mp4Path, m.Resolution); err != nil {
+		fmt.Println("Ошибка при впечатывании субтитров:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	captions := OpenCaptions{
+		Language:   m.Language,
+		Resolution: m.Resolution,
+		Mp4:        "/" + ffmpeg.StorageUri(storageDirName+"/"+mp4Name),
+	}
+
+	// Отдельный мастер-манифест: в общем манифесте плеер переключался бы на него при смене качества
+	if m.HLS {
+		segmentOutput := fmt.Sprintf("%v/%v_", folderDir, name)
+		manifest := fmt.Sprintf("%v/%v.m3u8", folderDir, name)
+		if err := ffmpeg.CreateSegments(mp4Path, segmentOutput, m.Resolution, ffmpeg.EncodeOptions{}); err != nil {
+			fmt.Printf("Ошибка при создании сегментов %v: %v\n", name, err)
+		} else {
+			bandwidth, err := ffmpeg.SegmentsBandwidth(segmentOutput)
+			if err != nil {
+				fmt.Printf("Ошибка при расчете битрейта %v: %v\n", name, err)
+			}
+			codecs, _ := ffmpeg.CodecsString(ffmpeg.CodecH264)
+			master := ffmpeg.MasterPlaylist{Variants: []ffmpeg.Variant{{
+				Resolution: m.Resolution,
+				Uri:        segmentOutput + ".m3u8?alt=media",
+				Bandwidth:  bandwidth,
+				Codec:      ffmpeg.CodecH264,
+				Codecs:     codecs,
+			}}}
+			if err := ffmpeg.CreateMasterM3U8(manifest, master); err != nil {
+				fmt.Println("Ошибка при создании файла манифеста:", err)
+			}
+
+			files, err := filepath.Glob(segmentOutput + "*")
+			if err != nil {
+				fmt.Printf("Error listing files: %v\n", err)
+			}
+			files = append(files, manifest)
+			if _, err := fb.UploadFilesToFireStorage(ctx, files, folderDir); err != nil {
+				fmt.Println("Ошибка при загрузке в Firestorage:", err)
+			} else {
+				captions.Hls = segmentUrl(m.Hash, name+".m3u8")
+			}
+		}
+	}
+
+	if _, err := fb.UploadFilesToFireStorage(ctx, []string{mp4Path}, storageDirName); err != nil {
+		fmt.Println("Ошибка при загрузке в Firestorage:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Запись метаданных в Firestore
+	metadata := map[string]interface{}{
+		"openCaptions": map[string]interface{}{
+			m.Language: captions,
+		},
+	}
+	if err := fb.UpdateVideoMetadata(ctx, metadata, m.Id); err != nil {
+		fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(captions)
+}
+
+func createSubtitlesHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Проверка метода запроса
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var m SubtitlesRequest
+
+	if r.Body == nil {
+		http.Error(w, "Please send a request body", 400)
+		return
+	}
+	err := json.NewDecoder(r.Body).Decode(&m)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if m.Hash == "" || m.Transcript == "" {
+		http.Error(w, "hash and transcript are required", 400)
+		return
+	}
+	// Язык дорожки берется из определенного языка речи
+	if m.Language == "" && m.Id != "" {
+		stream := StreamMetadata{}
+		if err := fb.GetVideoMetadata(context.Background(), m.Id, &stream); err != nil {
+			fmt.Printf("Ошибка чтения метаданных из Firestore: %v\n", err)
+		}
+		m.Language = stream.Language
+	}
+	if m.Language == "" {
+		m.Language = "ru"
+	}
+
+	segments, err := subtitles.ReadTranscript(m.Transcript)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	cues, err := subtitles.BuildCues(segments, m.Options)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	// Переводы прошлой транскрипции на этом языке устарели, другие языки остаются
+	if m.Id != "" && searchIndex != nil {
+		searchIndex.RemoveLanguage(m.Id, m.Language)
+	}
+	indexTranscript(m.Id, m.Language, "", segments)
+
+	captions, err := publishSubtitles(context.Background(), m, cues)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	vttUrl := captions["vtt"]
+
+	// Возврат успешного ответа
+	responseData := OutputData{
+		Message: fmt.Sprintf("Субтитры созданы: %v реплик", len(cues)),
+		Status:  http.StatusOK,
+		Url:     vttUrl,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(responseData)
+}
+
+type TranslateRequest struct {
+	Id         string            `json:"id"`
+	Hash       string            `json:"hash"`
+	Transcript string            `json:"transcript"`
+	Source     string            `json:"source"`
+	Languages  []string          `json:"languages"`
+	Options    subtitles.Options `json:"options"`
+}
+
+type TranslateResult struct {
+	Success bool              `json:"success"`
+	Tracks  map[string]string `json:"tracks"`
+	Errors  map[string]string `json:"errors"`
+}
+
+// translateSubtitlesHandle переводит транскрипцию и создает дорожку субтитров для каждого языка
+func translateSubtitlesHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Проверка метода запроса
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var m TranslateRequest
+
+	if r.Body == nil {
+		http.Error(w, "Please send a request body", 400)
+		return
+	}
+	err := json.NewDecoder(r.Body).Decode(&m)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if m.Hash == "" || m.Transcript == "" || len(m.Languages) == 0 {
+		http.Error(w, "hash, transcript and languages are required", 400)
+		return
+	}
+	if m.Source == "" && m.Id != "" {
+		stream := StreamMetadata{}
+		if err := fb.GetVideoMetadata(context.Background(), m.Id, &stream); err != nil {
+			fmt.Printf("Ошибка чтения метаданных из Firestore: %v\n", err)
+		}
+		m.Source = stream.Language
+	}
+	if m.Source == "" {
+		m.Source = "ru"
+	}
+
+	segments, err := subtitles.ReadTranscript(m.Transcript)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	translator, err := translate.NewTranslator()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	result := TranslateResult{
+		Success: true,
+		Tracks:  map[string]string{},
+		Errors:  map[string]string{},
+	}
+	transcripts := map[string]interface{}{}
+	for _, language := range m.Languages {
+		if language == m.Source {
+			continue
+		}
+		translated, err := translate.TranslateTranscript(context.Background(), translator, segments, m.Source, language)
+		if err != nil {
+			result.Errors[language] = err.Error()
+			continue
+		}
+
+		transcript := fmt.Sprintf("%v_%v.json", strings.TrimSuffix(m.Transcript, filepath.Ext(m.Transcript)), language)
+		if err := subtitles.WriteTranscript(translated, transcript); err != nil {
+			result.Errors[language] = err.Error()
+			continue
+		}
+		cues, err := subtitles.BuildCues(translated, m.Options)
+		if err != nil {
+			result.Errors[language] = err.Error()
+			continue
+		}
+
+		// Каждый язык — отдельная дорожка субтитров
+		captions, err := publishSubtitles(context.Background(), SubtitlesRequest{
+			Id:         m.Id,
+			Hash:       m.Hash,
+			Transcript: transcript,
+			Language:   language,
+			Options:    m.Options,
+		}, cues)
+		if err != nil {
+			result.Errors[language] = err.Error()
+			continue
+		}
+		result.Tracks[language] = captions["vtt"]
+		transcripts[language] = transcript
+		indexTranscript(m.Id, language, m.Source, translated)
+	}
+	result.Success = len(result.Errors) == 0
+
+	if m.Id != "" && len(transcripts) > 0 {
+		metadata := map[string]interface{}{
+			"transcripts": transcripts,
+		}
+		if err := fb.UpdateVideoMetadata(context.Background(), metadata, m.Id); err != nil {
+			fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// searchIndex полнотекстовый индекс транскрипций
+var searchIndex *search.Index
+
+// indexTranscript добавляет транскрипцию видео или ее перевод с языка source в поисковый индекс
+func indexTranscript(id, language, source string, segments []subtitles.Segment) {
+	if id == "" || searchIndex == nil {
+		return
+	}
+	if err := searchIndex.AddTranscript(id, language, source, segments); err != nil {
+		fmt.Printf("Ошибка индексации транскрипции %v: %v\n", id, err)
+		return
+	}
+	if err := searchIndex.Save(); err != nil {
+		fmt.Printf("Ошибка сохранения поискового индекса: %v\n", err)
+	}
+}
+
+type SearchResponse struct {
+	Query   string          `json:"query"`
+	Results []search.Result `json:"results"`
+}
+
+// searchHandle поиск по транскрипциям: GET /search?q=планка&limit=20
+func searchHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Проверка метода запроса
+	if r.Method != http.MethodGet {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
 	}
-	outputDir := "posters"
-	res, err := ffmpeg.CreatePoster(m.Video, outputDir, m.Timestamp, "poster")
-	if err != nil {
-		http.Error(w, err.Error(), 400)
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "Missing q", 400)
 		return
 	}
-	println(res)
-	// Возврат успешного ответа
-	responseMessage := fmt.Sprintf("Видео, %v! Time: %v", m.Video, m.Timestamp)
-	responseData := OutputData{
-		Message: responseMessage,
-		Status:  http.StatusOK,
-		Url:     m.Video,
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+
+	result := SearchResponse{
+		Query:   query,
+		Results: searchIndex.Search(query, limit),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	json.NewEncoder(w).Encode(responseData)
+	json.NewEncoder(w).Encode(result)
 }
 
-type Chapters struct {
-	Chapters []fb.Chapter `json:"chapters"`
-	Id       string       `json:"id"`
-	Hash     string       `json:"hash"`
+type ReindexVideo struct {
+	Id          string            `json:"id"`
+	Transcripts map[string]string `json:"transcripts"` // язык -> файл транскрипции
+	Source      string            `json:"source"`      // язык, с которого переведены остальные транскрипции
 }
 
-func createVTTHandle(w http.ResponseWriter, r *http.Request) {
+type ReindexRequest struct {
+	Videos []ReindexVideo `json:"videos"`
+}
+
+type ReindexResponse struct {
+	Indexed int      `json:"indexed"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// searchReindexHandle заново индексирует транскрипции видео, например записанных до появления поиска:
+// POST /search/reindex {"videos": [{"id": "...", "source": "ru", "transcripts": {"ru": "...json", "en": "...json"}}]}
+func searchReindexHandle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
@@ -434,88 +2351,115 @@ func createVTTHandle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var fl Chapters
+	var m ReindexRequest
 
 	if r.Body == nil {
 		http.Error(w, "Please send a request body", 400)
 		return
 	}
-	err := json.NewDecoder(r.Body).Decode(&fl)
+	err := json.NewDecoder(r.Body).Decode(&m)
 	if err != nil {
 		http.Error(w, err.Error(), 400)
 		return
 	}
-
-	fmt.Println(fl)
-
-	// Создание VTT файла
-	folderDir := fmt.Sprintf("segments/%v", fl.Hash)
-	outputPath := fmt.Sprintf("%v/%v.vtt", folderDir, fl.Hash)
-	err = createVTTFile(fl.Chapters, outputPath)
-	if err != nil {
-		fmt.Printf("Error creating VTT file: %v\n", err)
+	if len(m.Videos) == 0 {
+		http.Error(w, "videos are required", 400)
 		return
 	}
 
-	// Создание метаданных
-	metadata := map[string]interface{}{
-		"chapters": fl.Chapters,
-	}
-	// Запись метаданных в Firestore
-	err = fb.UpdateVideoMetadata(context.Background(), metadata, fl.Id)
-	if err != nil {
-		fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
-	}
-
-	files := []string{outputPath}
-
-	_, err = fb.UploadFilesToFireStorage(context.Background(), files, folderDir)
-	if err != nil {
-		fmt.Println("Ошибка при загрузке в Firestorage:", err)
+	result := ReindexResponse{}
+	for _, video := range m.Videos {
+		if video.Id == "" {
+			result.Errors = append(result.Errors, "video id is required")
+			continue
+		}
+		// Записи видео заменяются целиком, языки без транскрипции из индекса удаляются
+		searchIndex.Remove(video.Id)
+		for language, transcript := range video.Transcripts {
+			segments, err := subtitles.ReadTranscript(transcript)
+			if err == nil {
+				source := video.Source
+				if source == language {
+					source = ""
+				}
+				err = searchIndex.AddTranscript(video.Id, language, source, segments)
+			}
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s/%s: %v", video.Id, language, err))
+				continue
+			}
+			result.Indexed++
+		}
 	}
-
-	// println(res)
-	// Возврат успешного ответа
-	responseMessage := fmt.Sprintf("good %v", 0)
-	responseData := OutputData{
-		Message: responseMessage,
-		Status:  http.StatusOK,
-		Url:     "",
+	if err := searchIndex.Save(); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	json.NewEncoder(w).Encode(responseData)
+	json.NewEncoder(w).Encode(result)
 }
 
-func createVTTFile(chapters []fb.Chapter, outputPath string) error {
-	// Создание и открытие файла
-	file, err := os.Create(outputPath)
+// languageSampleDuration длительность фрагмента (сек) для определения языка
+var languageSampleDuration = 30.0
+
+// detectLanguage определяет язык речи по короткому фрагменту, если он не задан в запросе,
+// подбирает под него модель и сохраняет язык в метаданных видео
+func detectLanguage(ctx context.Context, id, audio string, opts *ai.Options) {
+	if opts.Language != "" {
+		return
+	}
+
+	// Пропускаем вступление: обычно там музыка
+	start := 0.0
+	if duration, err := ffmpeg.GetVideoDuration(audio); err == nil && duration > languageSampleDuration*2 {
+		start = math.Min(duration*0.2, duration-languageSampleDuration)
+	}
+
+	sample, err := os.CreateTemp("", "sample_*.wav")
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		fmt.Println("Ошибка создания временного файла:", err)
+		return
 	}
-	defer file.Close()
+	sample.Close()
+	defer os.Remove(sample.Name())
 
-	// Запись заголовка VTT
-	_, err = file.WriteString("WEBVTT\n\n")
+	if err := ffmpeg.ExtractAudioSample(audio, sample.Name(), start, languageSampleDuration); err != nil {
+		fmt.Println("Ошибка при вырезании фрагмента аудио:", err)
+		return
+	}
+	detection, err := ai.DetectLanguage(ctx, sample.Name(), ai.Options{Device: opts.Device})
 	if err != nil {
-		return fmt.Errorf("failed to write to file: %w", err)
+		fmt.Println("Ошибка определения языка:", err)
+		return
 	}
+	fmt.Printf("Язык: %v (%.2f)\n", detection.Language, detection.Confidence)
 
-	// Запись субтитров
-	for _, chapters := range chapters {
-		_, err := file.WriteString(fmt.Sprintf("%s --> %s\n%s\n\n", chapters.Start, chapters.End, chapters.Text))
-		if err != nil {
-			return fmt.Errorf("failed to write subtitle to file: %w", err)
-		}
+	opts.Language = detection.Language
+	if opts.Model == "" {
+		opts.Model = ai.ModelForLanguage(detection.Language, "")
 	}
 
-	return nil
+	if id == "" {
+		return
+	}
+	metadata := map[string]interface{}{
+		"language":           detection.Language,
+		"languageConfidence": detection.Confidence,
+		"languageReview":     detection.Review,
+	}
+	if err := fb.UpdateVideoMetadata(ctx, metadata, id); err != nil {
+		fmt.Printf("Ошибка записи метаданных в Firestore: %v", err)
+	}
 }
 
 type Transcription struct {
-	Data string `json:"data"`
+	Id      string     `json:"id"`
+	Data    string     `json:"data"`
+	Backend string     `json:"backend"` // wscribe, whispercpp или http
+	Options ai.Options `json:"options"`
 }
 
 func transcriptionHandlerWS(w http.ResponseWriter, r *http.Request) {
@@ -537,7 +2481,10 @@ func transcriptionHandlerWS(w http.ResponseWriter, r *http.Request) {
 		method.ErrorMessageWS(conn, err, "Ошибка декодирования JSON:")
 	}
 
-	err = ai.GetSubtitlesJSONws(conn, "audios/output_audio.wav")
+	audio := "audios/output_audio.wav"
+	detectLanguage(context.Background(), req.Id, audio, &req.Options)
+
+	err = ai.GetSubtitlesJSONws(conn, audio, req.Backend, req.Options)
 	if err != nil {
 		fmt.Println("failed:", err)
 	}
@@ -578,7 +2525,9 @@ func transcriptionHandler(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Println(m)
 
-	err = ai.GetSubtitlesJSON()
+	detectLanguage(context.Background(), m.Id, "audios/output_audio.m4a", &m.Options)
+
+	err = ai.GetSubtitlesJSON(m.Backend, m.Options)
 	if err != nil {
 		// http.Error(w, err.Error(), 400)
 		fmt.Println("failed:", err)
@@ -714,6 +2663,7 @@ func preprocessVideoHandler(w http.ResponseWriter, r *http.Request) {
 		Created: time.Now(),
 		Updated: time.Now(),
 		Ratio:   ratio,
+		Creator: r.URL.Query().Get("creator"),
 	}
 	// Запись метаданных в Firestore
 	ref, err := fb.SaveVideoCreatorMetadata(context.Background(), metadata, "creator")
@@ -740,14 +2690,334 @@ func preprocessVideoHandler(w http.ResponseWriter, r *http.Request) {
 	conn.WriteMessage(websocket.TextMessage, bytes)
 }
 
+// liveStreams прием живых потоков, файлы раздаются из stream/live
+var liveStreams *live.Manager
+
+// LiveRequest запуск приема живого потока
+type LiveRequest struct {
+	Key string `json:"key"`
+	live.Options
+}
+
+// liveHandle POST запускает прием по ключу, GET возвращает состояние (?key= или все потоки), DELETE останавливает.
+// Локальная проверка: POST {"key":"test"}, затем ffmpeg -re -i video.mp4 -c:v libx264 -c:a aac -f flv rtmp://localhost:1935/live/test
+func liveHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var result interface{}
+	switch r.Method {
+	case http.MethodPost:
+		var req LiveRequest
+		if r.Body == nil {
+			http.Error(w, "Please send a request body", 400)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		status, err := liveStreams.Start(req.Key, req.Options)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		result = status
+	case http.MethodGet:
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			result = liveStreams.List()
+			break
+		}
+		status, ok := liveStreams.Status(key)
+		if !ok {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		result = status
+	case http.MethodDelete:
+		key := r.URL.Query().Get("key")
+		if err := liveStreams.Stop(key); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		result, _ = liveStreams.Status(key)
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// ArchiveRequest повторная архивация записи эфира с другой обрезкой начала и конца
+type ArchiveRequest struct {
+	Key       string  `json:"key"`
+	Title     string  `json:"title"`
+	TrimStart float64 `json:"trimStart"`
+	TrimEnd   float64 `json:"trimEnd"`
+}
+
+// archiveLiveStream превращает запись завершенного эфира в видео: сегменты старшей ступени склеиваются,
+// вырезаются подготовка до занятия и время после него, файл проходит обычное сегментирование
+func archiveLiveStream(status live.Status, req ArchiveRequest) live.Archive {
+	liveStreams.SetArchive(status.Key, live.Archive{State: live.ArchiveRunning})
+	archive := live.Archive{State: live.ArchiveFailed}
+	id, url, err := publishLiveRecording(status, req)
+	if err != nil {
+		fmt.Printf("Ошибка архивации эфира %v: %v\n", status.Key, err)
+		archive.Error = err.Error()
+	} else {
+		archive = live.Archive{State: live.ArchiveDone, Id: id, Url: url}
+	}
+	liveStreams.SetArchive(status.Key, archive)
+	return archive
+}
+
+func publishLiveRecording(status live.Status, req ArchiveRequest) (string, string, error) {
+	if req.TrimStart < 0 || req.TrimEnd < 0 {
+		return "", "", fmt.Errorf("trim must not be negative")
+	}
+
+	liveDir := "live"
+	recording, err := derivedTempFile(liveDir)
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(recording)
+	if err := liveStreams.Recording(status.Key, recording); err != nil {
+		return "", "", err
+	}
+
+	source := recording
+	if req.TrimStart > 0 || req.TrimEnd > 0 {
+		duration, err := ffmpeg.GetVideoDuration(recording)
+		if err != nil {
+			return "", "", err
+		}
+		if req.TrimStart+req.TrimEnd >= duration {
+			return "", "", fmt.Errorf("trim is longer than the recording (%.1f s)", duration)
+		}
+		source, err = derivedTempFile(liveDir)
+		if err != nil {
+			return "", "", err
+		}
+		defer os.Remove(source)
+		ranges := []ffmpeg.ClipRange{{Start: req.TrimStart, End: duration - req.TrimEnd}}
+		if err := ffmpeg.Clip(recording, source, ranges, true); err != nil {
+			return "", "", err
+		}
+	}
+
+	title := req.Title
+	if title == "" {
+		title = fmt.Sprintf("%v %v", status.Key, status.Created.Format("2006-01-02 15:04"))
+	}
+	return publishDerivedVideo(context.Background(), DerivedVideo{
+		File:        source,
+		Dir:         liveDir,
+		Title:       title,
+		Resolutions: status.Options.Resolutions,
+		Metadata: map[string]interface{}{
+			"live": map[string]interface{}{
+				"key":       status.Key,
+				"started":   status.Started,
+				"ended":     status.Ended,
+				"trimStart": req.TrimStart,
+				"trimEnd":   req.TrimEnd,
+			},
+		},
+	})
+}
+
+// liveArchiveHandle архивирует запись завершенного эфира заново, например с другой обрезкой.
+// Сегменты эфира хранятся до следующего запуска потока с тем же ключом
+func liveArchiveHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Проверка метода запроса
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ArchiveRequest
+	if r.Body == nil {
+		http.Error(w, "Please send a request body", 400)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	status, ok := liveStreams.Status(req.Key)
+	if !ok {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	if status.Archive != nil && status.Archive.State == live.ArchiveRunning {
+		http.Error(w, "Archive is already running", http.StatusConflict)
+		return
+	}
+
+	archive := archiveLiveStream(status, req)
+	if archive.State == live.ArchiveFailed {
+		http.Error(w, archive.Error, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(archive)
+}
+
+// channels линейные каналы из готовых видео
+var channels = channel.NewManager()
+
+// channelHandle POST сохраняет канал с расписанием, GET ?id= возвращает его
+func channelHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	ctx := context.Background()
+	var result channel.Channel
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		if r.Body == nil {
+			http.Error(w, "Please send a request body", 400)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := channels.Save(ctx, result); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	case http.MethodGet:
+		var err error
+		if result, _, err = channels.Channel(ctx, r.URL.Query().Get("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// channelPlayoutHandle эфир канала: /channel/{id}/master.m3u8, плейлисты вариантов /channel/{id}/720.m3u8,
+// звук /channel/{id}/audio.m3u8 и программа передач /channel/{id}/epg.json?hours=24
+func channelPlayoutHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	id, file, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/channel/"), "/")
+	if !found || id == "" {
+		http.NotFound(w, r)
+		return
+	}
+	ch, assets, err := channels.Channel(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case file == "epg.json":
+		hours, err := strconv.Atoi(r.URL.Query().Get("hours"))
+		if err != nil || hours <= 0 {
+			hours = 24
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ch.EPG(assets, now.Add(-time.Hour), now.Add(time.Duration(hours)*time.Hour)))
+	case file == "master.m3u8":
+		playlist, err := ch.Master(assets)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		fmt.Fprint(w, playlist)
+	case strings.HasSuffix(file, ".m3u8"):
+		playlist, err := ch.Playlist(assets, strings.TrimSuffix(file, ".m3u8"), now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprint(w, playlist)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
 func main() {
 	// r := mux.NewRouter()
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
+	searchIndex, err = search.Open("search/index.json")
+	if err != nil {
+		log.Fatalf("Failed to open search index: %v", err)
+	}
+
 	segmentDir := "stream"
 	http.Handle("/stream/", http.StripPrefix("/stream/", http.FileServer(http.Dir(segmentDir))))
+	liveStreams = live.NewManager(filepath.Join(segmentDir, "live"), "/stream/live")
+	liveStreams.LowLatencyPath = "/live/ll"
+	http.Handle("/live/ll/", http.StripPrefix("/live/ll", llhls.Handler(filepath.Join(segmentDir, "live"), liveStreams.LowLatency)))
+	liveStreams.OnEnd = func(status live.Status) {
+		archiveLiveStream(status, ArchiveRequest{
+			Key:       status.Key,
+			Title:     status.Options.Title,
+			TrimStart: status.Options.TrimStart,
+			TrimEnd:   status.Options.TrimEnd,
+		})
+	}
+	http.HandleFunc("/live", liveHandle)
+	http.HandleFunc("/live/archive", liveArchiveHandle)
+	http.HandleFunc("/channel", channelHandle)
+	http.HandleFunc("/channel/", channelPlayoutHandle)
 
 	// r := mux.NewRouter()
 	// Загрузка и конвертация видео
@@ -756,6 +3026,20 @@ func main() {
 	http.HandleFunc("/convert", convertVideoHandler)
 	http.HandleFunc("/poster", creatPosterHandle)
 	http.HandleFunc("/vttfile", createVTTHandle)
+	http.HandleFunc("/chapters/suggest", suggestChaptersHandle)
+	http.HandleFunc("/subtitles", createSubtitlesHandle)
+	http.HandleFunc("/subtitles/burn", burnSubtitlesHandle)
+	http.HandleFunc("/translate", translateSubtitlesHandle)
+	http.HandleFunc("/search", searchHandle)
+	http.HandleFunc("/search/reindex", searchReindexHandle)
+	http.HandleFunc("/quality", qualityHandle)
+	http.HandleFunc("/clip", clipHandle)
+	http.HandleFunc("/compose", composeHandle)
+	http.HandleFunc("/reframe", reframeHandle)
+	// Локальная замена сервиса перевода: TRANSLATE_URL=http://HOST:4003/translate-standin
+	if os.Getenv("TRANSLATE_STANDIN") != "" {
+		http.Handle("/translate-standin/", http.StripPrefix("/translate-standin", translate.StandInHandler()))
+	}
 	http.HandleFunc("/ws-transcription", transcriptionHandlerWS)
 	http.HandleFunc("/transcription", transcriptionHandler)
 	http.HandleFunc("/upload-video", preprocessVideoHandler)